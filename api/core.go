@@ -1,51 +1,85 @@
 package api
 
 import (
-	"fmt"
-	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
 
-	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 
 	"github.com/emicklei/go-restful"
 	"github.com/emicklei/go-restful/swagger"
 
+	"../apierror"
+	"../config"
 	"../database"
 	"../gjwt"
+	"../logger"
+	"../metrics"
 	"../models"
+	"../ratelimit"
 )
 
 // This example is functionally the same as the example in restful-user-resource.go
 // with the only difference that is served using the restful.DefaultContainer
 
 type ApiService struct {
-	collection *mgo.Collection
-	path       string
-	jwtService *gjwt.JwtService
+	store          models.Store
+	settings       *models.ModelSettings
+	collectionName string
+	path           string
+	config         *config.Config
+	mailer         *Mailer
+	jwtService     *gjwt.JwtService
+	oneTimeTokens  gjwt.OneTimeStore
+	cursorKey      []byte
+	log            *logger.Logger
 }
 
-func NewApiService(ModelSettings *models.ModelSettings) *ApiService {
+func NewApiService(store models.Store, cfg *config.Config, log *logger.Logger, ModelSettings *models.ModelSettings) *ApiService {
 
 	as := new(ApiService)
-	as.collection = database.GMyDb.GetCollection(ModelSettings.CollectionName)
+	as.store = store
+	as.config = cfg
+	as.log = log.WithField("collection", ModelSettings.CollectionName)
+	as.mailer = NewMailer(cfg.Mail)
+	as.settings = ModelSettings
+	as.collectionName = ModelSettings.CollectionName
 	as.path = ModelSettings.Path
+	as.cursorKey = newCursorKey(cfg, as.collectionName)
 
 	ws := new(restful.WebService)
 	ws.
 		Path("/api"+as.path).
-		Consumes(restful.MIME_JSON, restful.MIME_JSON).
-		Produces(restful.MIME_JSON, restful.MIME_JSON) // you can specify this per route as well
+		Consumes(restful.MIME_JSON, MIME_JSONAPI).
+		Produces(restful.MIME_JSON, MIME_JSONAPI). // you can specify this per route as well
+		Filter(newJsonApiFilter()).
+		Filter(as.ipRateLimit()).
+		Filter(gJwtService.Authenticate). // every route needs a token, Require checks its permissions
+		Filter(as.rateLimit())
+
+	resource := ModelSettings.CollectionName
 
 	ws.Route(ws.GET("/").To(as.findAll).
+		Filter(as.Require(resource, models.ActionRead)).
 		// docs
 		Doc("get all "+ModelSettings.Noun).
 		Operation("findAll"+ModelSettings.Noun+"s").
+		Param(ws.QueryParameter("filter[field][op]", "filter on a field of "+strings.Join(ModelSettings.FilterableFields, ", ")+"; op is one of eq (default), ne, gt, gte, lt, lte, in, regex").DataType("string")).
+		Param(ws.QueryParameter("sort", "comma separated fields of "+strings.Join(ModelSettings.SortableFields, ", ")+", prefixed with - for descending order").DataType("string")).
+		Param(ws.QueryParameter("fields["+ModelSettings.CollectionName+"]", "comma separated fields to return").DataType("string")).
+		Param(ws.QueryParameter("page[offset]", "index of the first result").DataType("integer")).
+		Param(ws.QueryParameter("page[limit]", "number of results, 10 by default").DataType("integer")).
+		Param(ws.QueryParameter("page[after]", "cursor from a next link; empty for the first page").DataType("string")).
+		Param(ws.QueryParameter("page[before]", "cursor from a prev link; empty for the last page").DataType("string")).
 		Returns(200, "OK", nil))
 
 	ws.Route(ws.GET("/{id}").To(as.find).
+		Filter(as.Require(resource, models.ActionRead)).
 		// docs
 		Doc("get a " + ModelSettings.Noun).
 		Operation("find" + ModelSettings.Noun).
@@ -53,6 +87,7 @@ func NewApiService(ModelSettings *models.ModelSettings) *ApiService {
 		Writes(ModelSettings.DataStruct)) // on the response
 
 	ws.Route(ws.PUT("/{id}").To(as.update).
+		Filter(as.Require(resource, models.ActionWrite)).
 		// docs
 		Doc("update a " + ModelSettings.Noun).
 		Operation("update" + ModelSettings.Noun).
@@ -60,12 +95,14 @@ func NewApiService(ModelSettings *models.ModelSettings) *ApiService {
 		Reads(ModelSettings.DataStruct)) // from the request
 
 	ws.Route(ws.POST("").To(as.create).
+		Filter(as.Require(resource, models.ActionWrite)).
 		// docs
 		Doc("create a " + ModelSettings.Noun).
 		Operation("create" + ModelSettings.Noun).
 		Reads(ModelSettings.DataStruct)) // from the request
 
 	ws.Route(ws.DELETE("/{id}").To(as.remove).
+		Filter(as.Require(resource, models.ActionDelete)).
 		// docs
 		Doc("delete a " + ModelSettings.Noun).
 		Operation("remove" + ModelSettings.Noun).
@@ -81,57 +118,85 @@ func NewApiService(ModelSettings *models.ModelSettings) *ApiService {
 //
 func (as *ApiService) findAll(request *restful.Request, response *restful.Response) {
 
-	pageOffset, err := strconv.Atoi(request.QueryParameter("page[offset]"))
+	list, err := as.parseQuery(request)
 	if err != nil {
-		pageOffset = 0
+		writeAPIError(response, err)
+		return
 	}
 
-	pageLimit, err := strconv.Atoi(request.QueryParameter("page[limit]"))
-	if err != nil {
-		pageLimit = 10
+	// applied after the client's filters so they cannot widen it
+	if requestScope(request) != models.ScopeAny {
+		if as.settings.OwnerField == "" {
+			writeAPIError(response, apierror.ErrForbidden)
+			return
+		}
+		list.query.Filter[as.settings.OwnerField] = principalId(request)
 	}
 
-	query := bson.M{}
-
-	authInfo := as.AuthInfo(request, response)
-	fmt.Println("ang kita all")
-	fmt.Printf("authInfo is %v", authInfo)
-	if !as.IsAdmin(authInfo) {
-		query = bson.M{"_id": bson.ObjectIdHex(authInfo["_id"].(string))}
+	var data bson.M
+	if list.cursor {
+		data, err = models.FindPage("/api"+as.path, as.C(request), list.query, list.token, list.before, as.cursorKey, list.linkParams)
+	} else {
+		data, err = models.FindAll("/api"+as.path, as.C(request), list.query, list.linkParams)
+	}
+	if err == models.ErrInvalidCursor {
+		param := "page[after]"
+		if list.before {
+			param = "page[before]"
+		}
+		err = models.ErrInvalidCursor.WithDetails(apierror.Detail{Code: "invalid_cursor", Message: "Invalid cursor", Parameter: param})
 	}
-	data, err := models.FindAll(as.path, as.collection, query, pageOffset, pageLimit)
 	if err != nil {
-		response.WriteErrorString(http.StatusNotFound, "Empty data")
+		writeAPIError(response, err)
 		return
 	}
+	resources := []*Resource{}
+	for _, doc := range data["data"].([]bson.M) {
+		if err := as.runHooks(request, "", as.hooks().AfterRead, doc); err != nil {
+			writeAPIError(response, err)
+			return
+		}
+		as.settings.Hide(doc)
+		resources = append(resources, as.resource(doc))
+	}
 
 	// cors(response)
-	response.WriteEntity(data)
+	writeDocument(response, http.StatusOK, &Document{Data: resources,
+		Links: data["links"].(bson.M), Meta: data["meta"].(bson.M)})
+}
+
+// load returns the document with the given id if the request can access it.
+func (as *ApiService) load(request *restful.Request, id string) (*bson.M, error) {
+	doc, err := models.FindId(as.C(request), id)
+	if err == models.ErrNotFound {
+		return nil, apierror.ErrNotFound.WithMessage(as.settings.Noun + " could not be found.")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !as.canAccess(request, *doc) {
+		return nil, apierror.ErrForbidden
+	}
+	return doc, nil
 }
 
 // GET http://localhost:8080/{noun_url}/1
 //
 func (as *ApiService) find(request *restful.Request, response *restful.Response) {
 	id := request.PathParameter("id")
-	if len(id) == 0 {
-		response.WriteErrorString(http.StatusBadRequest, "Invalid Request")
+	data, err := as.load(request, id)
+	if err != nil {
+		writeAPIError(response, err)
 		return
 	}
-	authInfo := as.AuthInfo(request, response)
-	if !as.IsAdmin(authInfo) {
-		if authInfo["_id"].(string) != id {
-			response.WriteErrorString(http.StatusBadRequest, "Invalid Request")
-			return
-		}
-	}
-	data, err := models.FindId(as.collection, id)
-	if err != nil {
-		response.WriteErrorString(http.StatusNotFound, "User could not be found.")
+	if err := as.runHooks(request, id, as.hooks().AfterRead, *data); err != nil {
+		writeAPIError(response, err)
 		return
 	}
+	as.settings.Hide(*data)
 
 	// cors(response)
-	response.WriteEntity(bson.M{"data": data})
+	writeDocument(response, http.StatusOK, &Document{Data: as.resource(*data)})
 }
 
 // PUT http://localhost:8080/{noun_url}/1
@@ -140,128 +205,271 @@ func (as *ApiService) find(request *restful.Request, response *restful.Response)
 func (as *ApiService) update(request *restful.Request, response *restful.Response) {
 
 	id := request.PathParameter("id")
+	current, err := as.load(request, id)
+	if err != nil {
+		writeAPIError(response, err)
+		return
+	}
 
-	authInfo := as.AuthInfo(request, response)
-	if !as.IsAdmin(authInfo) {
-		if authInfo["_id"].(string) != id {
-			response.WriteErrorString(http.StatusBadRequest, "Invalid Request")
-			return
-		}
+	data := as.readResource(request, response, id)
+	if data == nil {
+		return
 	}
 
-	data := bson.M{}
-	if err := request.ReadEntity(&data); err != nil {
-		fmt.Println("blank data")
-		response.WriteError(http.StatusInternalServerError, err)
+	if requestScope(request) != models.ScopeAny {
+		StripPrivilegedFields(data)
+	}
+
+	if err := as.settings.Schema.Validate(data, models.ValidateUpdate); err != nil {
+		writeAPIError(response, err)
 		return
 	}
 
-	if _, ok := data["password"]; ok {
-		data["password"] = GenPasswordHash(data["password"].(string))
+	if err := as.runHooks(request, id, as.hooks().BeforeUpdate, data); err != nil {
+		writeAPIError(response, err)
+		return
 	}
 
-	err := models.Update(as.collection, id, &data)
-	if err != nil {
-		fmt.Println("can't update")
-		response.WriteError(http.StatusInternalServerError, err)
+	if err := models.Update(as.C(request), id, &data); err != nil {
+		writeAPIError(response, err)
 		return
 	}
 
 	data["_id"] = id
+	if err := as.runHooks(request, id, as.hooks().AfterUpdate, data); err != nil {
+		writeAPIError(response, err)
+		return
+	}
+
+	// respond with the whole resource, not only the updated fields
+	for field, value := range data {
+		if field != "_id" {
+			(*current)[field] = value
+		}
+	}
+	as.settings.Hide(*current)
 
 	// cors(response)
-	response.WriteEntity(bson.M{"data": data})
+	writeDocument(response, http.StatusOK, &Document{Data: as.resource(*current)})
 }
 
 // PUT http://localhost:8080/{noun_url}/1
 // <User><Id>1</Id><Name>Melissa</Name></User>
 //
 func (as *ApiService) create(request *restful.Request, response *restful.Response) {
-	authInfo := as.AuthInfo(request, response)
-	if !as.IsAdmin(authInfo) {
-		response.WriteErrorString(http.StatusBadRequest, "Invalid Request")
+	scope := requestScope(request)
+	if scope != models.ScopeAny && !(as.settings.Policy.OwnerCreate && as.settings.OwnerField != "") {
+		writeAPIError(response, apierror.ErrForbidden)
+		return
+	}
+
+	data := as.readResource(request, response, "")
+	if data == nil {
+		return
+	}
+
+	if scope != models.ScopeAny {
+		StripPrivilegedFields(data)
+	}
+
+	if err := as.settings.Schema.Validate(data, models.ValidateCreate); err != nil {
+		writeAPIError(response, err)
 		return
 	}
+	data["_id"] = bson.NewObjectId()
+	if as.settings.OwnerField != "" && as.settings.OwnerField != "_id" {
+		data[as.settings.OwnerField] = principalId(request)
+	}
 
-	data := bson.M{"_id": bson.NewObjectId()}
-	if err := request.ReadEntity(&data); err != nil {
-		response.WriteError(http.StatusInternalServerError, err)
+	if err := as.runHooks(request, "", as.hooks().BeforeCreate, data); err != nil {
+		writeAPIError(response, err)
 		return
 	}
 
-	if _, ok := data["username"]; ok {
-		data["password"] = GenPasswordHash(data["password"].(string))
+	if err := models.Create(as.C(request), &data); err != nil {
+		writeAPIError(response, err)
+		return
 	}
 
-	if err := models.Create(as.collection, &data); err != nil {
-		response.WriteError(http.StatusInternalServerError, err)
+	id := data["_id"].(bson.ObjectId).Hex()
+	if err := as.runHooks(request, id, as.hooks().AfterCreate, data); err != nil {
+		writeAPIError(response, err)
 		return
 	}
+	as.settings.Hide(data)
 
 	// cors(response)
-	response.WriteEntity(bson.M{"data": data})
+	response.AddHeader("Location", as.resourceUrl(id))
+	writeDocument(response, http.StatusCreated, &Document{Data: as.resource(data)})
 }
 
 // DELETE http://localhost:8080/{noun_url}/1
 //
 func (as *ApiService) remove(request *restful.Request, response *restful.Response) {
 	id := request.PathParameter("id")
+	current, err := as.load(request, id)
+	if err != nil {
+		writeAPIError(response, err)
+		return
+	}
 
-	if len(id) == 0 {
-		response.WriteErrorString(http.StatusBadRequest, "Invalid Request")
+	if err := as.runHooks(request, id, as.hooks().BeforeDelete, *current); err != nil {
+		writeAPIError(response, err)
 		return
 	}
 
-	models.Remove(as.collection, id)
+	if err := models.Remove(as.C(request), id); err != nil {
+		writeAPIError(response, err)
+		return
+	}
+
+	if err := as.runHooks(request, id, as.hooks().AfterDelete, *current); err != nil {
+		writeAPIError(response, err)
+		return
+	}
 
 	// cors(response)
-	response.WriteHeader(200)
+	response.WriteHeader(http.StatusNoContent)
 }
 
-func enableCORS(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
-	resp.AddHeader("Access-Control-Allow-Origin", "http://"+strings.Replace(req.Request.Host, ":8080", "", 1))
-	resp.AddHeader("Access-Control-Allow-Credentials", "true")
-	resp.AddHeader("Access-Control-Allow-Methods", "POST, GET, PUT, DELETE")
-	resp.AddHeader("Access-Control-Allow-Headers", "Content-Type, Accept, Authorization, X-Requested-With")
-	resp.AddHeader("Access-Control-Max-Age", "28800")
-	resp.AddHeader("Content-Type", "application/json")
-	chain.ProcessFilter(req, resp)
+func newCORSFilter(cfg config.CorsConfig, listen string) restful.FilterFunction {
+	_, port, _ := net.SplitHostPort(listen)
+	return func(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
+		origin := "http://" + strings.Replace(req.Request.Host, ":"+port, "", 1)
+		if len(cfg.AllowedOrigins) > 0 {
+			origin = allowedOrigin(cfg.AllowedOrigins, req.HeaderParameter("Origin"))
+		}
+		if origin != "" {
+			resp.AddHeader("Access-Control-Allow-Origin", origin)
+		}
+		resp.AddHeader("Access-Control-Allow-Credentials", "true")
+		resp.AddHeader("Access-Control-Allow-Methods", strings.Join(cfg.AllowedMethods, ", "))
+		resp.AddHeader("Access-Control-Allow-Headers", strings.Join(cfg.AllowedHeaders, ", "))
+		resp.AddHeader("Access-Control-Max-Age", strconv.Itoa(cfg.MaxAge))
+		resp.AddHeader("Content-Type", "application/json")
+		chain.ProcessFilter(req, resp)
+	}
 }
 
-func enableOptions(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
-	if "OPTIONS" != req.Request.Method {
-		chain.ProcessFilter(req, resp)
-		return
+func allowedOrigin(allowed []string, origin string) string {
+	for _, o := range allowed {
+		if o == "*" || o == origin {
+			return origin
+		}
+	}
+	return ""
+}
+
+func newOptionsFilter(cfg config.CorsConfig) restful.FilterFunction {
+	return func(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
+		if "OPTIONS" != req.Request.Method {
+			chain.ProcessFilter(req, resp)
+			return
+		}
+		resp.AddHeader(restful.HEADER_Allow, strings.Join(cfg.AllowedMethods, ", "))
 	}
-	resp.AddHeader(restful.HEADER_Allow, "POST, GET, PUT, DELETE")
 }
 
-func Run() {
-	database.Init()
+// Run serves the API until SIGINT or SIGTERM, then shuts down gracefully and
+// closes the Mongo session. Errors are logged before being returned.
+func Run(cfg *config.Config) error {
+	level, _ := logger.ParseLevel(cfg.Log.Level)
+	log := logger.New(os.Stderr, level, cfg.Log.Format)
+
+	keys, err := loadKeys(cfg.Jwt)
+	if err != nil {
+		log.WithField("error", err).Error("can't load the jwt keys")
+		return err
+	}
+
+	if err := database.Init(cfg.Database, log); err != nil {
+		log.WithField("error", err).Error("can't connect to mongo")
+		return err
+	}
 	defer database.GMyDb.Destroy()
+	ensureIndexes(database.GMyDb, log)
+
+	auth := authStores{keys: keys}
+	if auth.revocations, err = gjwt.NewMgoRevocationStore(database.GMyDb.CopySession(), cfg.Database.Name); err != nil {
+		log.WithField("error", err).Error("can't set up token revocation")
+		return err
+	}
+	if auth.refreshTokens, err = gjwt.NewMgoRefreshStore(database.GMyDb.CopySession(), cfg.Database.Name); err != nil {
+		log.WithField("error", err).Error("can't set up refresh tokens")
+		return err
+	}
+	if auth.loginAttempts, err = gjwt.NewMgoAttemptStore(database.GMyDb.CopySession(), cfg.Database.Name, cfg.Login.Window.Duration); err != nil {
+		log.WithField("error", err).Error("can't set up login throttling")
+		return err
+	}
+	if auth.loginAudit, err = gjwt.NewMgoAuditLog(database.GMyDb.CopySession(), cfg.Database.Name, cfg.Login.AuditRetention.Duration); err != nil {
+		log.WithField("error", err).Error("can't set up the login audit trail")
+		return err
+	}
+	if auth.oneTimeTokens, err = gjwt.NewMgoOneTimeStore(database.GMyDb.CopySession(), cfg.Database.Name); err != nil {
+		log.WithField("error", err).Error("can't set up the tokens mailed to the users")
+		return err
+	}
+	var rateLimits ratelimit.Store = ratelimit.NewMemoryStore()
+	if cfg.RateLimit.Store == "mongo" {
+		if rateLimits, err = ratelimit.NewMgoStore(database.GMyDb.CopySession(), cfg.Database.Name); err != nil {
+			log.WithField("error", err).Error("can't set up rate limiting")
+			return err
+		}
+	}
 
-	registerAll()
+	store := newMgoStore(database.GMyDb.GetDatabase(), cfg.Database)
+	if err := migrateLegacyAdmin(store, log); err != nil {
+		log.WithField("error", err).Error("can't migrate the admin user")
+		return err
+	}
+	registerAll(store, auth, rateLimits, cfg, log)
 
-	restful.Filter(enableCORS)
-	restful.Filter(enableOptions)
+	restful.Filter(newRequestLogFilter(log))
+	restful.Filter(newMetricsFilter(restful.DefaultContainer))
+	restful.Filter(newSessionFilter(database.GMyDb, cfg.Database))
+	restful.Filter(newCORSFilter(cfg.Cors, cfg.Server.Listen))
+	restful.Filter(newOptionsFilter(cfg.Cors))
 
 	// Optionally, you can install the Swagger Service which provides a nice Web UI on your REST API
 	// You need to download the Swagger HTML5 assets and change the FilePath location in the config below.
 	// Open http://localhost:8080/apidocs and enter http://localhost:8080/apidocs.json in the api input field.
 	config := swagger.Config{
 		WebServices:    restful.RegisteredWebServices(), // you control what services are visible
-		WebServicesUrl: "/",
-		ApiPath:        "/apidocs.json",
+		WebServicesUrl: cfg.Swagger.WebServicesUrl,
+		ApiPath:        cfg.Swagger.ApiPath,
 
 		// Optionally, specifiy where the UI is located
-		SwaggerPath:     "/apidocs/",
-		SwaggerFilePath: "./swagger-ui2/dist"}
+		SwaggerPath:     cfg.Swagger.SwaggerPath,
+		SwaggerFilePath: cfg.Swagger.SwaggerFilePath}
 	swagger.InstallSwaggerService(config)
 
-	// log.Printf("start listening on :8080")
-	// server := &http.Server{Addr: "10.10.1.94:8080", Handler: wsContainer}
-	// log.Fatal(server.ListenAndServe())
+	restful.DefaultContainer.Handle("/metrics", metrics.Handler())
+
+	health := newHealthService(
+		healthCheck{name: "mongo", check: database.GMyDb.Ping},
+		healthCheck{name: "indexes", check: func() error { return checkIndexes(database.GMyDb) }},
+		healthCheck{name: "mail_queue", check: NewMailer(cfg.Mail).Ping, optional: true})
+	health.install(restful.DefaultContainer)
 
-	log.Printf("start listening on localhost:8080")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	server := &http.Server{
+		Handler:      restful.DefaultContainer,
+		ReadTimeout:  cfg.Server.ReadTimeout.Duration,
+		WriteTimeout: cfg.Server.WriteTimeout.Duration,
+		IdleTimeout:  cfg.Server.IdleTimeout.Duration}
+	listener, err := net.Listen("tcp", cfg.Server.Listen)
+	if err != nil {
+		log.WithField("error", err).Error("can't listen")
+		return err
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(stop)
+
+	err = serve(server, listener, health, stop, cfg.Server.DrainPeriod.Duration, cfg.Server.ShutdownTimeout.Duration, log)
+	if err != nil {
+		log.WithField("error", err).Error("server stopped")
+	}
+	return err
 }
@@ -28,7 +28,7 @@ func TestHashPassowrd(t *testing.T) {
 
 	for i, ok := range tests {
 		if CheckPassword(i.Original, i.Encrypted) != ok {
-			t.Errorf("Expected %s to be %b", i.Original, ok)
+			t.Errorf("Expected %s to be %t", i.Original, ok)
 		}
 		// tests[i]
 	}
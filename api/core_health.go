@@ -0,0 +1,155 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/emicklei/go-restful"
+
+	"../database"
+	"../logger"
+)
+
+const healthCheckTimeout = 2 * time.Second
+
+// healthCheck is a dependency checked by the readiness probe. A failing
+// optional check is reported but does not make the service unready.
+type healthCheck struct {
+	name     string
+	check    func() error
+	optional bool
+}
+
+type healthService struct {
+	checks   []healthCheck
+	timeout  time.Duration
+	draining int32
+}
+
+type healthStatus struct {
+	Status string                 `json:"status"`
+	Checks map[string]checkResult `json:"checks,omitempty"`
+}
+
+type checkResult struct {
+	Status    string  `json:"status"`
+	Error     string  `json:"error,omitempty"`
+	Optional  bool    `json:"optional,omitempty"`
+	LatencyMs float64 `json:"latency_ms"`
+}
+
+func newHealthService(checks ...healthCheck) *healthService {
+	return &healthService{checks: checks, timeout: healthCheckTimeout}
+}
+
+// install serves /healthz and /readyz outside of the web services, so probes
+// skip the filters and do not flood the request logs.
+func (hs *healthService) install(container *restful.Container) {
+	container.Handle("/healthz", http.HandlerFunc(hs.live))
+	container.Handle("/readyz", http.HandlerFunc(hs.ready))
+}
+
+// live tells the process is up; it checks nothing so a slow Mongo does not
+// get the container restarted.
+func (hs *healthService) live(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, http.StatusOK, &healthStatus{Status: "ok"})
+}
+
+// drain makes the readiness probe fail from now on, ahead of a shutdown.
+func (hs *healthService) drain() {
+	atomic.StoreInt32(&hs.draining, 1)
+}
+
+// ready runs the checks concurrently, each bounded by the timeout.
+func (hs *healthService) ready(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&hs.draining) != 0 {
+		writeHealth(w, http.StatusServiceUnavailable, &healthStatus{Status: "draining"})
+		return
+	}
+
+	results := make([]checkResult, len(hs.checks))
+	done := make(chan int, len(hs.checks))
+	for i, c := range hs.checks {
+		go func(i int, c healthCheck) {
+			results[i] = runCheck(c, hs.timeout)
+			done <- i
+		}(i, c)
+	}
+	for range hs.checks {
+		<-done
+	}
+
+	status := &healthStatus{Status: "ok", Checks: map[string]checkResult{}}
+	code := http.StatusOK
+	for i, c := range hs.checks {
+		status.Checks[c.name] = results[i]
+		if results[i].Status != "ok" && !c.optional {
+			status.Status = "unavailable"
+			code = http.StatusServiceUnavailable
+		}
+	}
+	writeHealth(w, code, status)
+}
+
+func runCheck(c healthCheck, timeout time.Duration) checkResult {
+	start := time.Now()
+	errs := make(chan error, 1)
+	go func() { errs <- c.check() }()
+
+	var err error
+	select {
+	case err = <-errs:
+	case <-time.After(timeout):
+		err = fmt.Errorf("timed out after %s", timeout)
+	}
+
+	result := checkResult{Status: "ok", Optional: c.optional,
+		LatencyMs: float64(time.Since(start).Nanoseconds()) / 1e6}
+	if err != nil {
+		result.Status = "error"
+		result.Error = err.Error()
+	}
+	return result
+}
+
+func writeHealth(w http.ResponseWriter, code int, status *healthStatus) {
+	w.Header().Set("Content-Type", restful.MIME_JSON)
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(status)
+}
+
+// ensureIndexes creates the unique indexes of the resources. Failures, like
+// existing duplicates, are logged and reported by the readiness probe.
+func ensureIndexes(myDb *database.MyDb, log *logger.Logger) {
+	for _, settings := range resources {
+		for _, field := range settings.UniqueFields {
+			ensure := myDb.EnsureUniqueIndex
+			if f, ok := settings.Schema.Field(field); ok && !f.Required {
+				ensure = myDb.EnsureSparseUniqueIndex
+			}
+			if err := ensure(settings.CollectionName, field); err != nil {
+				log.With(logger.Fields{"collection": settings.CollectionName, "field": field, "error": err}).
+					Error("can't create unique index")
+			}
+		}
+	}
+}
+
+func checkIndexes(myDb *database.MyDb) error {
+	for _, settings := range resources {
+		for _, field := range settings.UniqueFields {
+			ok, err := myDb.HasIndex(settings.CollectionName, field)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return fmt.Errorf("missing index on %s.%s", settings.CollectionName, field)
+			}
+		}
+	}
+	return nil
+}
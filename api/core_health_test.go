@@ -0,0 +1,56 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/emicklei/go-restful"
+)
+
+func TestHealth(t *testing.T) {
+	ok := func() error { return nil }
+	failing := func() error { return errors.New("connection refused") }
+	slow := func() error { time.Sleep(time.Second); return nil }
+
+	tests := []struct {
+		checks   []healthCheck
+		status   int
+		expected map[string]string
+	}{
+		{[]healthCheck{{name: "mongo", check: ok}, {name: "mail_queue", check: failing, optional: true}},
+			http.StatusOK, map[string]string{"mongo": "ok", "mail_queue": "error"}},
+		{[]healthCheck{{name: "mongo", check: failing}, {name: "indexes", check: ok}},
+			http.StatusServiceUnavailable, map[string]string{"mongo": "error", "indexes": "ok"}},
+		{[]healthCheck{{name: "mongo", check: slow}},
+			http.StatusServiceUnavailable, map[string]string{"mongo": "error"}},
+	}
+	for _, test := range tests {
+		hs := newHealthService(test.checks...)
+		hs.timeout = 50 * time.Millisecond
+		container := restful.NewContainer()
+		hs.install(container)
+
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/healthz", nil)
+		container.ServeHTTP(recorder, req)
+		if recorder.Code != http.StatusOK {
+			t.Errorf("Expected /healthz to be ok whatever the checks, got %d", recorder.Code)
+		}
+
+		recorder = httptest.NewRecorder()
+		req, _ = http.NewRequest("GET", "/readyz", nil)
+		container.ServeHTTP(recorder, req)
+		if recorder.Code != test.status {
+			t.Errorf("Expected /readyz to return %d, got %d", test.status, recorder.Code)
+		}
+		checks, _ := decodeBody(t, recorder)["checks"].(map[string]interface{})
+		for name, status := range test.expected {
+			if check, _ := checks[name].(map[string]interface{}); check == nil || check["status"] != status {
+				t.Errorf("Expected check %s to be %s, got %v", name, status, checks[name])
+			}
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package api
+
+import (
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/emicklei/go-restful"
+
+	"../models"
+)
+
+var noHooks = &models.Hooks{}
+
+func (as *ApiService) hooks() *models.Hooks {
+	if as.settings.Hooks == nil {
+		return noHooks
+	}
+	return as.settings.Hooks
+}
+
+// AddHooks appends hooks to the ones declared on the ModelSettings of the service.
+func (as *ApiService) AddHooks(hooks *models.Hooks) {
+	if as.settings.Hooks == nil {
+		as.settings.Hooks = &models.Hooks{}
+	}
+	h := as.settings.Hooks
+	h.BeforeCreate = append(h.BeforeCreate, hooks.BeforeCreate...)
+	h.AfterCreate = append(h.AfterCreate, hooks.AfterCreate...)
+	h.BeforeUpdate = append(h.BeforeUpdate, hooks.BeforeUpdate...)
+	h.AfterUpdate = append(h.AfterUpdate, hooks.AfterUpdate...)
+	h.BeforeDelete = append(h.BeforeDelete, hooks.BeforeDelete...)
+	h.AfterDelete = append(h.AfterDelete, hooks.AfterDelete...)
+	h.AfterRead = append(h.AfterRead, hooks.AfterRead...)
+}
+
+func (as *ApiService) runHooks(request *restful.Request, id string, hooks []models.Hook, doc bson.M) error {
+	ctx := &models.HookContext{
+		Settings:   as.settings,
+		Collection: as.C(request),
+		AuthInfo:   requestAuthInfo(request),
+		Id:         id,
+		Request:    request.Request,
+		Mailer:     as.mailer}
+	return models.RunHooks(hooks, ctx, doc)
+}
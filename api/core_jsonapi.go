@@ -0,0 +1,267 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/emicklei/go-restful"
+
+	"../apierror"
+	"../logger"
+)
+
+// MIME_JSONAPI is the JSON:API media type. Plain application/json is still
+// accepted and produced for older clients; the documents are the same.
+const MIME_JSONAPI = "application/vnd.api+json"
+
+var (
+	errUnsupportedMediaType = apierror.New(http.StatusUnsupportedMediaType, "unsupported_media_type", "JSON:API media type parameters are not supported")
+	errNotAcceptable        = apierror.New(http.StatusNotAcceptable, "not_acceptable", "JSON:API media type parameters are not supported")
+	errInvalidBody          = apierror.ErrBadRequest.WithCode("invalid_body").WithMessage("Request body must be a JSON object")
+)
+
+// Document is a JSON:API top level document.
+type Document struct {
+	Data    interface{}   `json:"data,omitempty"`
+	Errors  []ErrorObject `json:"errors,omitempty"`
+	Links   bson.M        `json:"links,omitempty"`
+	Meta    bson.M        `json:"meta,omitempty"`
+	JsonApi bson.M        `json:"jsonapi,omitempty"`
+}
+
+// Resource is a JSON:API resource object: the _id of a document becomes its
+// id, relationship fields its relationships and the rest its attributes.
+type Resource struct {
+	Type          string `json:"type"`
+	Id            string `json:"id,omitempty"`
+	Attributes    bson.M `json:"attributes"`
+	Relationships bson.M `json:"relationships,omitempty"`
+	Links         bson.M `json:"links,omitempty"`
+}
+
+type ErrorObject struct {
+	Status string       `json:"status"`
+	Code   string       `json:"code,omitempty"`
+	Detail string       `json:"detail,omitempty"`
+	Source *ErrorSource `json:"source,omitempty"`
+}
+
+// ErrorSource points at the part of the request that caused an error.
+type ErrorSource struct {
+	Pointer   string `json:"pointer,omitempty"`
+	Parameter string `json:"parameter,omitempty"`
+}
+
+// resourceIdentifier is the linkage of a relationship in request bodies.
+type resourceIdentifier struct {
+	Type string `json:"type"`
+	Id   string `json:"id"`
+}
+
+// resourceInput is the JSON:API form of POST and PUT bodies.
+type resourceInput struct {
+	Data *struct {
+		Type          string                 `json:"type"`
+		Id            string                 `json:"id"`
+		Attributes    map[string]interface{} `json:"attributes"`
+		Relationships map[string]struct {
+			Data *resourceIdentifier `json:"data"`
+		} `json:"relationships"`
+	} `json:"data"`
+}
+
+// newJsonApiFilter negotiates the media type as the JSON:API spec requires:
+// 415 when the request body is JSON:API with media type parameters, 406 when
+// every JSON:API media type accepted by the client has parameters. Responses
+// are JSON:API typed when the client accepts it.
+func newJsonApiFilter() restful.FilterFunction {
+	return func(request *restful.Request, response *restful.Response, chain *restful.FilterChain) {
+		if contentType := request.HeaderParameter("Content-Type"); contentType != "" && request.Request.ContentLength != 0 {
+			mediaType, params, err := mime.ParseMediaType(contentType)
+			if err == nil && mediaType == MIME_JSONAPI && len(params) > 0 {
+				writeAPIError(response, errUnsupportedMediaType)
+				return
+			}
+		}
+
+		accepted, rejected := false, false
+		for _, accept := range strings.Split(request.HeaderParameter("Accept"), ",") {
+			mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(accept))
+			if err != nil || mediaType != MIME_JSONAPI {
+				continue
+			}
+			if len(params) == 0 {
+				accepted = true
+			} else {
+				rejected = true
+			}
+		}
+		if rejected && !accepted {
+			writeAPIError(response, errNotAcceptable)
+			return
+		}
+
+		if accepted {
+			response.Header().Set("Content-Type", MIME_JSONAPI)
+		} else {
+			response.Header().Set("Content-Type", restful.MIME_JSON)
+		}
+		chain.ProcessFilter(request, response)
+	}
+}
+
+// writeDocument writes doc with the media type chosen by the JSON:API filter.
+func writeDocument(response *restful.Response, status int, doc *Document) {
+	if response.Header().Get("Content-Type") == "" {
+		response.Header().Set("Content-Type", restful.MIME_JSON)
+	}
+	doc.JsonApi = bson.M{"version": "1.0"}
+	response.WriteHeader(status)
+	json.NewEncoder(response).Encode(doc)
+}
+
+// writeAPIError is the single place errors are written: err is mapped with
+// apierror.From and written as an error document, one error per detail. The
+// causes of server errors are logged, never sent.
+func writeAPIError(response *restful.Response, err error) {
+	e := apierror.From(err)
+	if e.Status >= http.StatusInternalServerError {
+		gLogger.With(logger.Fields{"request_id": response.Header().Get(headerRequestId), "code": e.Code, "error": e}).
+			Error("request failed")
+	}
+
+	errs := []ErrorObject{}
+	for _, d := range e.Details {
+		obj := ErrorObject{Code: d.Code, Detail: d.Message}
+		if d.Pointer != "" || d.Parameter != "" {
+			obj.Source = &ErrorSource{Pointer: d.Pointer, Parameter: d.Parameter}
+		}
+		errs = append(errs, obj)
+	}
+	if len(errs) == 0 {
+		errs = append(errs, ErrorObject{Code: e.Code, Detail: e.Message})
+	}
+	writeErrors(response, e.Status, errs...)
+}
+
+// writeErrors writes an error document, filling in the status and the
+// default code of each error, the snake cased status text like not_found.
+func writeErrors(response *restful.Response, status int, errs ...ErrorObject) {
+	for i := range errs {
+		errs[i].Status = strconv.Itoa(status)
+		if errs[i].Code == "" {
+			errs[i].Code = strings.Replace(strings.ToLower(http.StatusText(status)), " ", "_", -1)
+		}
+	}
+	writeDocument(response, status, &Document{Errors: errs})
+}
+
+// resourceUrl is the self link of a document of the service.
+func (as *ApiService) resourceUrl(id string) string {
+	return "/api" + as.path + "/" + id
+}
+
+// resource turns a stored document into a resource object.
+func (as *ApiService) resource(doc bson.M) *Resource {
+	res := &Resource{Type: as.collectionName, Attributes: bson.M{}}
+	switch id := doc["_id"].(type) {
+	case bson.ObjectId:
+		res.Id = id.Hex()
+	case string:
+		res.Id = id
+	}
+	if res.Id != "" {
+		res.Links = bson.M{"self": as.resourceUrl(res.Id)}
+	}
+
+	for name, rel := range as.settings.Relationships {
+		if _, ok := doc[rel.Field]; !ok {
+			continue
+		}
+		var linkage interface{}
+		if id, ok := doc[rel.Field].(bson.ObjectId); ok {
+			linkage = resourceIdentifier{Type: rel.Type, Id: id.Hex()}
+		}
+		if res.Relationships == nil {
+			res.Relationships = bson.M{}
+		}
+		res.Relationships[name] = bson.M{"data": linkage}
+	}
+
+	for field, value := range doc {
+		if field == "_id" || as.settings.RelationshipOf(field) != "" {
+			continue
+		}
+		res.Attributes[field] = value
+	}
+	return res
+}
+
+// readResource decodes a POST or PUT body, either a JSON:API document or, for
+// older clients, the plain attributes. id is the id the resource must have,
+// empty on create. On failure the error is written and nil returned.
+func (as *ApiService) readResource(request *restful.Request, response *restful.Response, id string) bson.M {
+	body, err := ioutil.ReadAll(request.Request.Body)
+	plain := bson.M{}
+	if err == nil {
+		err = decodeJson(body, &plain)
+	}
+	if err != nil {
+		writeAPIError(response, errInvalidBody.WithCause(err))
+		return nil
+	}
+	if _, ok := plain["data"]; !ok {
+		return plain
+	}
+
+	input := resourceInput{}
+	if err := decodeJson(body, &input); err != nil || input.Data == nil {
+		writeAPIError(response, errInvalidBody.WithDetails(apierror.Detail{Code: "invalid_body",
+			Message: "data must be a resource object", Pointer: "/data"}))
+		return nil
+	}
+	if input.Data.Type != as.collectionName {
+		writeAPIError(response, apierror.ErrConflict.WithDetails(apierror.Detail{Code: "type_mismatch",
+			Message: "type must be " + as.collectionName, Pointer: "/data/type"}))
+		return nil
+	}
+	if input.Data.Id != id {
+		writeAPIError(response, apierror.ErrConflict.WithDetails(apierror.Detail{Code: "id_mismatch",
+			Message: "id must match the URL", Pointer: "/data/id"}))
+		return nil
+	}
+
+	data := bson.M{}
+	for field, value := range input.Data.Attributes {
+		data[field] = value
+	}
+	for name, rel := range input.Data.Relationships {
+		settings, ok := as.settings.Relationships[name]
+		if !ok || (rel.Data != nil && rel.Data.Type != settings.Type) {
+			writeAPIError(response, apierror.ErrBadRequest.WithDetails(apierror.Detail{Code: "invalid_relationship",
+				Message: "invalid relationship " + name, Pointer: "/data/relationships/" + name}))
+			return nil
+		}
+		if rel.Data == nil {
+			data[settings.Field] = nil
+		} else {
+			data[settings.Field] = rel.Data.Id
+		}
+	}
+	return data
+}
+
+// decodeJson decodes numbers as json.Number, like go-restful does, so the
+// schema can tell integers from floats.
+func decodeJson(body []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
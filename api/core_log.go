@@ -0,0 +1,69 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"regexp"
+	"time"
+
+	"github.com/emicklei/go-restful"
+
+	"../logger"
+)
+
+const (
+	headerRequestId = "X-Request-ID"
+	attrLogger      = "logger"
+)
+
+// gLogger is the logger of the service, set by registerAll.
+var gLogger *logger.Logger
+
+// requestIdPattern bounds the request ids taken from clients, so they cannot
+// inject arbitrary text into the logs.
+var requestIdPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// newRequestLogFilter propagates the X-Request-ID of the request, or assigns
+// one, and logs a line per request once it has been handled. Handlers log
+// through requestLogger so their lines carry the request id.
+func newRequestLogFilter(log *logger.Logger) restful.FilterFunction {
+	return func(request *restful.Request, response *restful.Response, chain *restful.FilterChain) {
+		start := time.Now()
+
+		id := request.HeaderParameter(headerRequestId)
+		if !requestIdPattern.MatchString(id) {
+			id = newRequestId()
+		}
+		response.AddHeader(headerRequestId, id)
+		requestLog := log.WithField("request_id", id)
+		request.SetAttribute(attrLogger, requestLog)
+
+		chain.ProcessFilter(request, response)
+
+		fields := logger.Fields{
+			"method":     request.Request.Method,
+			"path":       request.Request.URL.Path,
+			"status":     response.StatusCode(),
+			"latency_ms": float64(time.Since(start).Nanoseconds()) / 1e6,
+		}
+		if id := principalId(request); id != "" {
+			fields["user_id"] = id.Hex()
+		}
+		requestLog.With(fields).Info("request")
+	}
+}
+
+func newRequestId() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// requestLogger returns the logger of the request, falling back to the
+// service logger outside of the request log filter.
+func (as *ApiService) requestLogger(request *restful.Request) *logger.Logger {
+	if log, ok := request.Attribute(attrLogger).(*logger.Logger); ok {
+		return log
+	}
+	return as.log
+}
@@ -2,27 +2,98 @@ package api
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"text/template"
+	"time"
 
 	"gopkg.in/mgo.v2/bson"
+
+	"../config"
 )
 
-func SendMailViaQueue(from, to, subject, message string) {
+type Mailer struct {
+	QueueUrl string
+	From     string
+}
 
-	payload := bson.M{"from": from, "to": to, "subject": subject, "message": message}
+func NewMailer(cfg config.MailConfig) *Mailer {
+	return &Mailer{QueueUrl: cfg.QueueUrl, From: cfg.From}
+}
+
+// mailTemplate renders the mails sent to the users.
+type mailTemplate struct {
+	subject string
+	body    *template.Template
+}
+
+var verificationMail = mailTemplate{
+	subject: "Verify your email address",
+	body: template.Must(template.New("verification").Parse(`Hello {{.Username}},
+
+please verify your email address by following this link:
+
+{{.Link}}
+
+The link expires on {{.ExpiresAt.Format "2006-01-02 15:04 MST"}}. If you did not sign up, you can ignore this mail.
+`)),
+}
+
+var passwordResetMail = mailTemplate{
+	subject: "Reset your password",
+	body: template.Must(template.New("password_reset").Parse(`Hello {{.Username}},
+
+someone asked to reset the password of your account. To choose a new one, follow this link:
 
-	payloadMarshalled, err := bson.Marshal(payload)
+{{.Link}}
 
+The link expires on {{.ExpiresAt.Format "2006-01-02 15:04 MST"}}. If you did not ask for it, you can ignore this mail: your password stays the same.
+`)),
+}
+
+// Ping checks the mail queue answers, whatever the status.
+func (m *Mailer) Ping() error {
+	if m.QueueUrl == "" {
+		return errors.New("no queue url configured")
+	}
+	client := &http.Client{Timeout: 2 * time.Second}
+	res, err := client.Head(m.QueueUrl)
 	if err != nil {
-		return
+		return err
 	}
+	res.Body.Close()
+	return nil
+}
+
+// SendTemplate renders the template with data and sends it from From.
+func (m *Mailer) SendTemplate(to string, tmpl mailTemplate, data interface{}) error {
+	var message bytes.Buffer
+	if err := tmpl.body.Execute(&message, data); err != nil {
+		return err
+	}
+	return m.SendMailViaQueue(m.From, to, tmpl.subject, message.String())
+}
 
-	url := "http://localhost:8081"
-	res, err := http.Post(url, "application/json", bytes.NewBuffer(payloadMarshalled))
+func (m *Mailer) SendMailViaQueue(from, to, subject, message string) error {
+
+	payload := bson.M{"from": from, "to": to, "subject": subject, "message": message}
+
+	payloadMarshalled, err := json.Marshal(payload)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
+	client := &http.Client{Timeout: 10 * time.Second}
+	res, err := client.Post(m.QueueUrl, "application/json", bytes.NewBuffer(payloadMarshalled))
+	if err != nil {
+		return err
+	}
 	defer res.Body.Close()
 
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("mail queue answered %s", res.Status)
+	}
+	return nil
 }
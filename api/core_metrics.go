@@ -0,0 +1,37 @@
+package api
+
+import (
+	"sync"
+	"time"
+
+	"github.com/emicklei/go-restful"
+
+	"../metrics"
+)
+
+// newMetricsFilter records the count and latency of the requests served by
+// container, labelled with the Operation of their route, like findAllUsers.
+// The routes are looked up on the first request, once every web service has
+// been added.
+func newMetricsFilter(container *restful.Container) restful.FilterFunction {
+	var once sync.Once
+	operations := map[string]string{}
+	return func(request *restful.Request, response *restful.Response, chain *restful.FilterChain) {
+		once.Do(func() {
+			for _, ws := range container.RegisteredWebServices() {
+				for _, route := range ws.Routes() {
+					operations[route.Method+" "+route.Path] = route.Operation
+				}
+			}
+		})
+
+		start := time.Now()
+		chain.ProcessFilter(request, response)
+
+		operation, ok := operations[request.Request.Method+" "+request.SelectedRoutePath()]
+		if !ok || operation == "" {
+			operation = "unknown"
+		}
+		metrics.ObserveRequest(operation, request.Request.Method, response.StatusCode(), start)
+	}
+}
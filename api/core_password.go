@@ -0,0 +1,138 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/emicklei/go-restful"
+
+	"../apierror"
+	"../gjwt"
+	"../logger"
+	"../models"
+)
+
+var errInvalidReset = apierror.ErrBadRequest.WithCode("invalid_reset_token").WithMessage("Password reset link is invalid or has expired")
+
+type ForgotPasswordStruct struct {
+	Email string `json:"email"`
+}
+
+type ResetPasswordStruct struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+// POST http://localhost:8080/api/auth/password/forgot
+// {"email": "melissa@example.com"}
+//
+// forgotPassword mails a password reset link to the user with the address.
+// The answer is the same whether the account exists or not, and the mail is
+// sent in the background so that the response time doesn't tell either.
+func (as *ApiService) forgotPassword(request *restful.Request, response *restful.Response) {
+	data := ForgotPasswordStruct{}
+	if err := request.ReadEntity(&data); err != nil {
+		writeAPIError(response, apierror.ErrBadRequest.WithCode("invalid_body").WithCause(err))
+		return
+	}
+
+	if data.Email != "" {
+		go as.sendPasswordReset(data.Email, as.requestLogger(request))
+	}
+	response.WriteHeader(http.StatusAccepted)
+}
+
+// sendPasswordReset runs after the request, so it uses the store of the
+// service rather than the one of the request.
+func (as *ApiService) sendPasswordReset(email string, log *logger.Logger) {
+	usr, err := models.FindOne(as.store.C(as.collectionName), &bson.M{"email": email, "deleted_at": bson.M{"$exists": false}})
+	if err == models.ErrNotFound {
+		log.Info("password reset asked for an unknown email address")
+		return
+	}
+	if err == nil {
+		log = log.WithField("user_id", usr["_id"].(bson.ObjectId).Hex())
+		err = as.mailToken(usr, gjwt.PurposeResetPassword, as.config.Account.ResetTimeout.Duration, passwordResetMail, as.config.Account.ResetUrl)
+	}
+	if err != nil {
+		log.WithField("error", err).Error("can't send the password reset mail")
+		return
+	}
+	log.Info("password reset mail sent")
+}
+
+// POST http://localhost:8080/api/auth/password/reset
+// {"token": "TOKEN", "password": "new password"}
+//
+// resetPassword sets the password of the user the token was mailed to, and
+// logs them out of every device. The token only works once.
+func (as *ApiService) resetPassword(request *restful.Request, response *restful.Response) {
+	data := ResetPasswordStruct{}
+	if err := request.ReadEntity(&data); err != nil {
+		writeAPIError(response, apierror.ErrBadRequest.WithCode("invalid_body").WithCause(err))
+		return
+	}
+	if err := as.settings.Schema.Validate(bson.M{"password": data.Password}, models.ValidateUpdate); err != nil {
+		writeAPIError(response, err)
+		return
+	}
+	if data.Token == "" {
+		writeAPIError(response, errInvalidReset)
+		return
+	}
+
+	stored, err := as.oneTimeTokens.Use(gjwt.PurposeResetPassword, gjwt.HashOneTimeToken(data.Token))
+	if err != nil {
+		writeAPIError(response, apierror.ErrInternal.WithCause(err))
+		return
+	}
+	if stored == nil || stored.ExpiresAt.Before(time.Now()) {
+		writeAPIError(response, errInvalidReset)
+		return
+	}
+	if !bson.IsObjectIdHex(stored.UserId) {
+		writeAPIError(response, errInvalidReset)
+		return
+	}
+	// deleted users can't come back through a reset
+	account := bson.M{"_id": bson.ObjectIdHex(stored.UserId), "deleted_at": bson.M{"$exists": false}}
+	usr, err := models.FindOne(as.C(request), &account)
+	if err == models.ErrNotFound {
+		writeAPIError(response, errInvalidReset)
+		return
+	}
+	if err != nil {
+		writeAPIError(response, err)
+		return
+	}
+
+	hash, err := GenPasswordHash(data.Password)
+	if err != nil {
+		writeAPIError(response, apierror.ErrInternal.WithCause(err))
+		return
+	}
+	// owning the mailbox also lifts a lockout by someone guessing the password
+	set := bson.M{"password": hash, "failed_logins": 0}
+	// the mail reached the user, which verifies the address
+	if usr["email"] == stored.Email {
+		set["email_verified"] = true
+	}
+	_, err = models.Apply(as.C(request), &account, &bson.M{"$set": set, "$unset": bson.M{"locked_until": ""}})
+	if err == models.ErrNotFound {
+		writeAPIError(response, errInvalidReset)
+		return
+	}
+	if err != nil {
+		writeAPIError(response, err)
+		return
+	}
+	if err := gJwtService.RevokeUser(stored.UserId); err != nil {
+		writeAPIError(response, apierror.ErrInternal.WithCause(err))
+		return
+	}
+
+	as.requestLogger(request).WithField("user_id", stored.UserId).Info("password reset")
+	response.WriteHeader(http.StatusNoContent)
+}
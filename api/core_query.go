@@ -0,0 +1,230 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/emicklei/go-restful"
+
+	"../apierror"
+	"../config"
+	"../models"
+)
+
+const (
+	defaultPageLimit = 10
+	maxPageLimit     = 100
+	// maxRegexLength bounds filter[field][regex] patterns, which Mongo runs unindexed.
+	maxRegexLength = 64
+)
+
+var filterParam = regexp.MustCompile(`^filter\[([^\]]+)\](?:\[([a-z]+)\])?$`)
+
+// filterOperators maps the operators accepted in filter[field][op] to Mongo's.
+var filterOperators = map[string]string{
+	"eq":    "$eq",
+	"ne":    "$ne",
+	"gt":    "$gt",
+	"gte":   "$gte",
+	"lt":    "$lt",
+	"lte":   "$lte",
+	"in":    "$in",
+	"regex": "$regex",
+}
+
+// listRequest is a parsed findAll request.
+type listRequest struct {
+	query *models.Query
+	// linkParams are the filter, sort and fields parameters, repeated in the
+	// pagination links.
+	linkParams string
+
+	// cursor is set for keyset pagination with page[after] or page[before],
+	// token being their value and before telling which one was given.
+	cursor bool
+	token  string
+	before bool
+}
+
+// parseQuery translates the filter, sort, fields and page query parameters of
+// a findAll request into a models.Query. Only the fields whitelisted in the
+// ModelSettings can be filtered and sorted on, so clients cannot build
+// arbitrary Mongo queries.
+func (as *ApiService) parseQuery(request *restful.Request) (*listRequest, error) {
+	params := request.Request.URL.Query()
+	query := &models.Query{Filter: bson.M{}, Limit: defaultPageLimit}
+	list := &listRequest{query: query}
+	links := url.Values{}
+
+	if offset := params.Get("page[offset]"); offset != "" {
+		skip, err := strconv.Atoi(offset)
+		if err != nil || skip < 0 {
+			return nil, newParameterError("page[offset]", "invalid value %q", offset)
+		}
+		query.Skip = skip
+	}
+	if limit := params.Get("page[limit]"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > maxPageLimit {
+			return nil, newParameterError("page[limit]", "must be between 1 and %d", maxPageLimit)
+		}
+		query.Limit = n
+	}
+
+	// an empty page[after] starts from the first document, page[before] from the last
+	after, isAfter := params["page[after]"]
+	before, isBefore := params["page[before]"]
+	switch {
+	case isAfter && isBefore:
+		return nil, newParameterError("page[before]", "cannot be combined with page[after]")
+	case (isAfter || isBefore) && query.Skip > 0:
+		return nil, newParameterError("page[offset]", "cannot be combined with a cursor")
+	case isAfter:
+		list.cursor, list.token = true, after[0]
+	case isBefore:
+		list.cursor, list.token, list.before = true, before[0], true
+	}
+
+	for name, values := range params {
+		match := filterParam.FindStringSubmatch(name)
+		if match == nil {
+			continue
+		}
+		if err := as.addFilter(query.Filter, match[1], match[2], values[0]); err != nil {
+			return nil, newParameterError(name, "%v", err)
+		}
+		links.Set(name, values[0])
+	}
+
+	if sort := params.Get("sort"); sort != "" {
+		for _, key := range strings.Split(sort, ",") {
+			if !contains(as.settings.SortableFields, strings.TrimPrefix(key, "-")) {
+				return nil, newParameterError("sort", "cannot sort on %q", key)
+			}
+			query.Sort = append(query.Sort, key)
+		}
+		links.Set("sort", sort)
+	} else if len(as.settings.DefaultSort) > 0 {
+		query.Sort = as.settings.DefaultSort
+	} else {
+		query.Sort = []string{"_id"}
+	}
+
+	fieldsParam := "fields[" + as.collectionName + "]"
+	if fields := params.Get(fieldsParam); fields != "" {
+		for _, name := range strings.Split(fields, ",") {
+			if _, ok := as.settings.Schema.Field(name); !ok || as.settings.IsHidden(name) {
+				return nil, newParameterError(fieldsParam, "unknown field %q", name)
+			}
+			query.Fields = append(query.Fields, name)
+		}
+		// the owner field is needed to check access to the documents
+		if as.settings.OwnerField != "" && !contains(query.Fields, as.settings.OwnerField) {
+			query.Fields = append(query.Fields, as.settings.OwnerField)
+		}
+		links.Set(fieldsParam, fields)
+	}
+
+	list.linkParams = links.Encode()
+	return list, nil
+}
+
+// newParameterError rejects a query string parameter.
+func newParameterError(parameter, format string, a ...interface{}) *apierror.Error {
+	message := fmt.Sprintf(format, a...)
+	return apierror.ErrBadRequest.WithCode("invalid_parameter").WithMessage(parameter + ": " + message).
+		WithDetails(apierror.Detail{Code: "invalid_parameter", Message: message, Parameter: parameter})
+}
+
+// addFilter adds the condition of a filter[field][op]=value parameter to filter.
+func (as *ApiService) addFilter(filter bson.M, name, op, value string) error {
+	field, ok := as.settings.Schema.Field(name)
+	if !ok || !contains(as.settings.FilterableFields, name) {
+		return fmt.Errorf("cannot filter on %q", name)
+	}
+	if op == "" {
+		op = "eq"
+	}
+	mongoOp, ok := filterOperators[op]
+	if !ok {
+		return fmt.Errorf("unknown operator %q", op)
+	}
+
+	var arg interface{}
+	switch op {
+	case "in":
+		values := []interface{}{}
+		for _, s := range strings.Split(value, ",") {
+			v, err := field.ParseValue(s)
+			if err != nil {
+				return err
+			}
+			values = append(values, v)
+		}
+		arg = values
+	case "regex":
+		if field.Type != models.TypeString {
+			return fmt.Errorf("only string fields can be matched")
+		}
+		if len(value) > maxRegexLength {
+			return fmt.Errorf("pattern longer than %d characters", maxRegexLength)
+		}
+		if _, err := regexp.Compile(value); err != nil {
+			return err
+		}
+		arg = bson.RegEx{Pattern: value}
+	default:
+		v, err := field.ParseValue(value)
+		if err != nil {
+			return err
+		}
+		arg = v
+	}
+
+	conditions, _ := filter[name].(bson.M)
+	if conditions == nil {
+		conditions = bson.M{}
+		filter[name] = conditions
+	}
+	conditions[mongoOp] = arg
+	return nil
+}
+
+// randomCursorKey signs the cursors when no server.cursor_key is configured;
+// they are then invalidated on restart.
+var randomCursorKey = func() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return key
+}()
+
+// newCursorKey derives the key signing the cursors of a collection, so that
+// they cannot be replayed against another one.
+func newCursorKey(cfg *config.Config, collectionName string) []byte {
+	secret := []byte(cfg.Server.CursorKey)
+	if len(secret) == 0 {
+		secret = randomCursorKey
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(collectionName))
+	return mac.Sum(nil)
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
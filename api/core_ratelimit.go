@@ -0,0 +1,104 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/emicklei/go-restful"
+
+	"../apierror"
+	"../config"
+	"../gjwt"
+	"../models"
+	"../ratelimit"
+)
+
+var errRateLimited = apierror.New(http.StatusTooManyRequests, "rate_limited", "Too many requests, retry later")
+
+// gRateLimits holds the buckets of the rate limit filters, set by registerAll.
+// Requests are not limited when nil.
+var gRateLimits ratelimit.Store
+
+// defaultRateLimit is the limit of the routes without their own in the
+// RateLimits of their ModelSettings.
+func defaultRateLimit(cfg config.RateLimitConfig) ratelimit.Limit {
+	return ratelimit.Limit{Requests: cfg.Requests, Period: cfg.Period.Duration}
+}
+
+// newRateLimitFilter limits the requests of each user, or of each client IP
+// before authentication, in the given scope: routes sharing a scope share
+// their buckets. The state of the bucket is sent in the RateLimit-Limit,
+// RateLimit-Remaining and RateLimit-Reset headers, unless an earlier filter
+// reported a bucket with fewer requests left; requests over the limit get 429.
+func newRateLimitFilter(scope string, limit ratelimit.Limit) restful.FilterFunction {
+	return func(request *restful.Request, response *restful.Response, chain *restful.FilterChain) {
+		if gRateLimits == nil || limit.Unlimited() {
+			chain.ProcessFilter(request, response)
+			return
+		}
+
+		key := scope + ":ip:" + gjwt.ClientIP(request.Request)
+		// the id of a verified token, checked to be its sub
+		if principal := gjwt.PrincipalOf(request); principal != nil {
+			key = scope + ":user:" + principal.Id
+		}
+		result, err := gRateLimits.Take(key, limit, time.Now())
+		if err != nil {
+			// an unavailable store must not take the API down with it
+			gLogger.WithField("error", err).Warn("can't check the rate limit")
+			chain.ProcessFilter(request, response)
+			return
+		}
+
+		header := response.Header()
+		if remaining, err := strconv.Atoi(header.Get("RateLimit-Remaining")); err != nil || result.Remaining <= remaining {
+			header.Set("RateLimit-Limit", strconv.Itoa(limit.Requests))
+			header.Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+			header.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(result.Reset)))
+		}
+		if !result.Allowed {
+			header.Set("Retry-After", strconv.Itoa(ceilSeconds(result.RetryAfter)))
+			writeAPIError(response, errRateLimited)
+			return
+		}
+		chain.ProcessFilter(request, response)
+	}
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int((d + time.Second - 1) / time.Second)
+}
+
+// ipRateLimit returns the filter limiting the requests of each client IP to
+// the default limit, before authentication, so that requests with bad tokens
+// are limited too.
+func (as *ApiService) ipRateLimit() restful.FilterFunction {
+	return newRateLimitFilter("api", defaultRateLimit(as.config.RateLimit))
+}
+
+// rateLimit returns the filter limiting the requests of each user, after
+// authentication, to the limit of the action of the route, told by the
+// request method: the limit of the action in the ModelSettings, in its own
+// scope, or the default limit shared by all the routes.
+func (as *ApiService) rateLimit() restful.FilterFunction {
+	filters := map[string]restful.FilterFunction{}
+	for method, action := range map[string]string{
+		"GET":    models.ActionRead,
+		"POST":   models.ActionWrite,
+		"PUT":    models.ActionWrite,
+		"DELETE": models.ActionDelete} {
+		if limit, ok := as.settings.RateLimits[action]; ok {
+			filters[method] = newRateLimitFilter(as.collectionName+":"+action, limit)
+		} else {
+			filters[method] = newRateLimitFilter("default", defaultRateLimit(as.config.RateLimit))
+		}
+	}
+	return func(request *restful.Request, response *restful.Response, chain *restful.FilterChain) {
+		if filter, ok := filters[request.Request.Method]; ok {
+			filter(request, response, chain)
+			return
+		}
+		chain.ProcessFilter(request, response)
+	}
+}
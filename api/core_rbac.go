@@ -0,0 +1,106 @@
+package api
+
+import (
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/emicklei/go-restful"
+
+	"../apierror"
+	"../gjwt"
+	"../logger"
+	"../models"
+)
+
+const attrPermissionScope = "permissionScope"
+
+// Require returns a route filter that lets the request through only when the
+// token grants the action on the resource. It runs after the authentication
+// filter. The granted scope is stored in the request attributes so handlers
+// can restrict "self" access to the caller's own documents.
+func (as *ApiService) Require(resource, action string) restful.FilterFunction {
+	return func(request *restful.Request, response *restful.Response, chain *restful.FilterChain) {
+		principal := gjwt.PrincipalOf(request)
+		if principal == nil {
+			writeAPIError(response, gjwt.ErrMissingToken)
+			return
+		}
+
+		scope := models.PermissionScope(principal.Permissions, resource, action)
+		if scope == "" {
+			writeAPIError(response, apierror.ErrForbidden)
+			return
+		}
+
+		request.SetAttribute(attrPermissionScope, scope)
+		chain.ProcessFilter(request, response)
+	}
+}
+
+// requestAuthInfo returns the principal of the request as hooks get it, nil
+// for anonymous requests.
+func requestAuthInfo(request *restful.Request) bson.M {
+	principal := gjwt.PrincipalOf(request)
+	if principal == nil {
+		return nil
+	}
+	return bson.M{"_id": principal.Id, "username": principal.Username,
+		"roles": principal.Roles, "permissions": principal.Permissions}
+}
+
+func requestScope(request *restful.Request) string {
+	scope, _ := request.Attribute(attrPermissionScope).(string)
+	return scope
+}
+
+// principalId returns the id of the authenticated user as stored in owner
+// fields, empty for anonymous requests.
+func principalId(request *restful.Request) bson.ObjectId {
+	principal := gjwt.PrincipalOf(request)
+	if principal == nil || !bson.IsObjectIdHex(principal.Id) {
+		return ""
+	}
+	return bson.ObjectIdHex(principal.Id)
+}
+
+// canAccess tells whether the scope granted by Require covers the document:
+// "any" covers everything, "self" only the documents the principal owns.
+func (as *ApiService) canAccess(request *restful.Request, doc bson.M) bool {
+	if requestScope(request) == models.ScopeAny {
+		return true
+	}
+	id := principalId(request)
+	return id != "" && as.settings.IsOwnedBy(doc, id)
+}
+
+// StripPrivilegedFields removes the fields that only "any" writers may set.
+func StripPrivilegedFields(data bson.M) {
+	for _, field := range models.PrivilegedFields {
+		delete(data, field)
+	}
+}
+
+// userClaims is used by the JwtService to embed the roles and the resolved
+// permissions of a user in its tokens.
+func (as *ApiService) userClaims(usr bson.M) map[string]interface{} {
+	return map[string]interface{}{
+		"roles":       models.UserRoles(usr),
+		"permissions": models.UserPermissions(usr),
+	}
+}
+
+// migrateLegacyAdmin grants the admin role to the user named admin, the
+// administrator of the versions before roles, when it has no roles yet. The
+// other users without roles keep DefaultRoles.
+func migrateLegacyAdmin(store models.Store, log *logger.Logger) error {
+	usr, err := models.Apply(store.C(models.ModelSettingsUser.CollectionName),
+		&bson.M{"username": "admin", "roles": bson.M{"$exists": false}, "deleted_at": bson.M{"$exists": false}},
+		&bson.M{"$set": bson.M{"roles": []string{"admin"}}})
+	if err == models.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	log.WithField("user_id", usr["_id"].(bson.ObjectId).Hex()).Warn("granted the admin role to the legacy admin user")
+	return nil
+}
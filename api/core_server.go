@@ -0,0 +1,41 @@
+package api
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"../logger"
+)
+
+// serve serves on listener until the server fails or a signal is received on
+// stop. It then drains: the readiness probe fails for drain, so that load
+// balancers stop sending requests, and in-flight requests get up to timeout
+// to complete.
+func serve(server *http.Server, listener net.Listener, health *healthService, stop <-chan os.Signal,
+	drain, timeout time.Duration, log *logger.Logger) error {
+
+	errs := make(chan error, 1)
+	go func() { errs <- server.Serve(listener) }()
+	log.WithField("listen", listener.Addr().String()).Info("start listening")
+
+	select {
+	case err := <-errs:
+		return err
+	case sig := <-stop:
+		log.With(logger.Fields{"signal": sig.String(), "drain": drain.String()}).Info("shutting down")
+	}
+
+	health.drain()
+	time.Sleep(drain)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		return err
+	}
+	log.Info("server stopped")
+	return nil
+}
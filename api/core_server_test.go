@@ -0,0 +1,66 @@
+package api
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"../logger"
+)
+
+func TestGracefulShutdown(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := "http://" + listener.Addr().String()
+
+	health := newHealthService()
+	started := make(chan bool)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/readyz", health.ready)
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		started <- true
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte("done"))
+	})
+
+	stop := make(chan os.Signal, 1)
+	done := make(chan error)
+	go func() {
+		done <- serve(&http.Server{Handler: mux}, listener, health, stop, 100*time.Millisecond, time.Second, logger.Discard())
+	}()
+
+	slow := make(chan string)
+	go func() {
+		res, err := http.Get(url + "/slow")
+		if err != nil {
+			slow <- err.Error()
+			return
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		slow <- string(body)
+	}()
+	<-started
+	stop <- syscall.SIGTERM
+
+	time.Sleep(20 * time.Millisecond)
+	if res, err := http.Get(url + "/readyz"); err != nil || res.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected readiness to fail while draining, got %v %v", res, err)
+	}
+
+	if body := <-slow; body != "done" {
+		t.Errorf("Expected the in-flight request to complete, got %q", body)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("Expected a clean shutdown, got %v", err)
+	}
+	if _, err := http.Get(url + "/readyz"); err == nil {
+		t.Errorf("Expected the server to be closed")
+	}
+}
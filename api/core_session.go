@@ -0,0 +1,42 @@
+package api
+
+import (
+	"gopkg.in/mgo.v2"
+
+	"github.com/emicklei/go-restful"
+
+	"../config"
+	"../database"
+	"../models"
+)
+
+const attrStore = "store"
+
+// newSessionFilter gives every request its own copy of the Mongo session and
+// closes it once the request has been handled, so concurrent requests don't
+// share a socket and a failed socket is not reused by the next request.
+func newSessionFilter(myDb *database.MyDb, cfg config.DatabaseConfig) restful.FilterFunction {
+	return func(request *restful.Request, response *restful.Response, chain *restful.FilterChain) {
+		session := myDb.CopySession()
+		defer session.Close()
+
+		request.SetAttribute(attrStore, newMgoStore(myDb.SessionDatabase(session), cfg))
+		chain.ProcessFilter(request, response)
+	}
+}
+
+func newMgoStore(db *mgo.Database, cfg config.DatabaseConfig) *models.MgoStore {
+	store := models.NewMgoStore(db)
+	store.Retries = cfg.OperationRetries
+	store.Backoff = cfg.RetryBackoff.Duration
+	return store
+}
+
+// C resolves the service collection from the request-scoped store installed
+// by the session filter, falling back to the store the service was built with.
+func (as *ApiService) C(request *restful.Request) models.Collection {
+	if store, ok := request.Attribute(attrStore).(models.Store); ok {
+		return store.C(as.collectionName)
+	}
+	return as.store.C(as.collectionName)
+}
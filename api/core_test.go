@@ -0,0 +1,923 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/emicklei/go-restful"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+
+	"../config"
+	"../gjwt"
+	"../logger"
+	"../metrics"
+	"../models"
+	"../ratelimit"
+)
+
+type Note struct {
+	Id      bson.ObjectId `json:"_id,omitempty" access:"server"`
+	OwnerId bson.ObjectId `json:"owner_id,omitempty" access:"server"`
+	Text    string        `json:"text" maxLength:"140"`
+	Secret  string        `json:"secret,omitempty"`
+	Reads   int           `json:"reads,omitempty" access:"readonly"`
+}
+
+var (
+	testStore *models.MemoryStore
+	testAudit = &gjwt.MemoryAuditLog{}
+	testMails = &mailQueue{}
+	testOnce  sync.Once
+
+	modelSettingsNote = &models.ModelSettings{
+		Path:           "/notes",
+		Noun:           "Note",
+		CollectionName: "notes",
+		DataStruct:     Note{},
+		Schema:         models.SchemaOf(Note{}),
+		OwnerField:     "owner_id",
+		Policy:         models.AccessPolicy{OwnerCreate: true},
+		HiddenFields:   []string{"secret"},
+		Relationships:  map[string]models.Relationship{"owner": {Field: "owner_id", Type: "users"}}}
+
+	modelSettingsDraft = &models.ModelSettings{
+		Path:           "/drafts",
+		Noun:           "Draft",
+		CollectionName: "drafts",
+		DataStruct:     Note{},
+		Schema:         models.SchemaOf(Note{}),
+		OwnerField:     "owner_id",
+		RateLimits:     map[string]ratelimit.Limit{models.ActionWrite: {Requests: 2, Period: time.Minute}}}
+)
+
+// setupTestApi serves the whole API from the in-memory store, with an admin
+// and a regular user.
+func setupTestApi(t *testing.T) {
+	testOnce.Do(func() {
+		testStore = models.NewMemoryStore()
+		cfg := config.Default()
+		cfg.Jwt.Key = "test key"
+		cfg.Mail.QueueUrl = httptest.NewServer(testMails).URL
+		registerAll(testStore, authStores{
+			revocations:   gjwt.NewMemoryRevocationStore(),
+			refreshTokens: gjwt.NewMemoryRefreshStore(),
+			loginAttempts: gjwt.NewMemoryAttemptStore(cfg.Login.Window.Duration),
+			loginAudit:    testAudit,
+			oneTimeTokens: gjwt.NewMemoryOneTimeStore()}, ratelimit.NewMemoryStore(), cfg, logger.Discard())
+		NewApiService(testStore, cfg, logger.Discard(), modelSettingsNote)
+		NewApiService(testStore, cfg, logger.Discard(), modelSettingsDraft)
+
+		for _, usr := range []bson.M{
+			{"username": "admin", "password": "adminpass", "roles": []string{"admin"}},
+			{"username": "melissa", "password": "raspberry",
+				"permissions": []string{"notes:read:self", "notes:write:self", "notes:delete:self"}},
+		} {
+			hash, _ := GenPasswordHash(usr["password"].(string))
+			usr["password"] = hash
+			models.Create(testStore.C("users"), &usr)
+		}
+	})
+}
+
+// mailQueue records the mails posted to the mail queue.
+type mailQueue struct {
+	mutex sync.Mutex
+	mails []bson.M
+}
+
+func (mq *mailQueue) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	mail := bson.M{}
+	json.NewDecoder(r.Body).Decode(&mail)
+	mq.mutex.Lock()
+	defer mq.mutex.Unlock()
+	mq.mails = append(mq.mails, mail)
+}
+
+// last returns the last mail with the subject sent to the address.
+func (mq *mailQueue) last(to, subject string) bson.M {
+	mq.mutex.Lock()
+	defer mq.mutex.Unlock()
+	for i := len(mq.mails) - 1; i >= 0; i-- {
+		if mq.mails[i]["to"] == to && mq.mails[i]["subject"] == subject {
+			return mq.mails[i]
+		}
+	}
+	return nil
+}
+
+func doRequest(method, path, token string, body interface{}) *httptest.ResponseRecorder {
+	return doRequestAs(method, path, token, restful.MIME_JSON, body)
+}
+
+// doRequestAs sends and accepts the given media type.
+func doRequestAs(method, path, token, mediaType string, body interface{}) *httptest.ResponseRecorder {
+	var payload bytes.Buffer
+	if body != nil {
+		json.NewEncoder(&payload).Encode(body)
+	}
+	req, _ := http.NewRequest(method, path, &payload)
+	req.Header.Set("Content-Type", mediaType)
+	req.Header.Set("Accept", mediaType)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	recorder := httptest.NewRecorder()
+	restful.DefaultContainer.ServeHTTP(recorder, req)
+	return recorder
+}
+
+func decodeBody(t *testing.T, recorder *httptest.ResponseRecorder) bson.M {
+	body := bson.M{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil {
+		t.Fatalf("Invalid json response %q: %v", recorder.Body.String(), err)
+	}
+	return body
+}
+
+// attributes returns the attributes of a resource object.
+func attributes(resource interface{}) map[string]interface{} {
+	return resource.(map[string]interface{})["attributes"].(map[string]interface{})
+}
+
+// errorCode returns the code of the first error of an error document.
+func errorCode(t *testing.T, recorder *httptest.ResponseRecorder) string {
+	errs, _ := decodeBody(t, recorder)["errors"].([]interface{})
+	if len(errs) == 0 {
+		t.Fatalf("Expected an error document, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	return errs[0].(map[string]interface{})["code"].(string)
+}
+
+func login(t *testing.T, username, password string) string {
+	recorder := doRequest("POST", "/api/auth/login", "", bson.M{"username": username, "password": password})
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Login of %s failed with %d: %s", username, recorder.Code, recorder.Body.String())
+	}
+	return decodeBody(t, recorder)["meta"].(map[string]interface{})["token"].(string)
+}
+
+func TestUsersAccess(t *testing.T) {
+	setupTestApi(t)
+	adminToken := login(t, "admin", "adminpass")
+	userToken := login(t, "melissa", "raspberry")
+
+	recorder := doRequest("GET", "/api/users/", adminToken, nil)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected admin to list users, got %d", recorder.Code)
+	}
+	users := decodeBody(t, recorder)["data"].([]interface{})
+	if len(users) < 2 {
+		t.Errorf("Expected admin to see every user, got %v", users)
+	}
+	for _, usr := range users {
+		if _, ok := attributes(usr)["password"]; ok {
+			t.Errorf("Expected password hashes to be hidden")
+		}
+	}
+
+	recorder = doRequest("GET", "/api/users/", userToken, nil)
+	if users := decodeBody(t, recorder)["data"].([]interface{}); len(users) != 1 {
+		t.Errorf("Expected a user to only see itself, got %v", users)
+	}
+
+	recorder = doRequest("POST", "/api/users", userToken, bson.M{"username": "mallory", "password": "x"})
+	if recorder.Code != http.StatusForbidden {
+		t.Errorf("Expected a user not to create users, got %d", recorder.Code)
+	}
+
+	recorder = doRequest("GET", "/api/users/", "", nil)
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("Expected anonymous listing to be unauthorized, got %d", recorder.Code)
+	}
+}
+
+func TestMigrateLegacyAdmin(t *testing.T) {
+	store := models.NewMemoryStore()
+	users := store.C("users")
+	models.Create(users, &bson.M{"username": "admin"})
+	models.Create(users, &bson.M{"username": "melissa"})
+
+	for i := 0; i < 2; i++ {
+		if err := migrateLegacyAdmin(store, logger.Discard()); err != nil {
+			t.Fatalf("Migration failed: %v", err)
+		}
+	}
+	admin, _ := models.FindOne(users, &bson.M{"username": "admin"})
+	if roles := models.UserRoles(admin); fmt.Sprint(roles) != "[admin]" {
+		t.Errorf("Expected the legacy admin to get the admin role, got %v", roles)
+	}
+	melissa, _ := models.FindOne(users, &bson.M{"username": "melissa"})
+	if _, ok := melissa["roles"]; ok {
+		t.Errorf("Expected the other users to be left alone, got %v", melissa)
+	}
+
+	// roles given since are kept
+	models.Update(users, admin["_id"].(bson.ObjectId).Hex(), &bson.M{"roles": []string{"user"}})
+	migrateLegacyAdmin(store, logger.Discard())
+	admin, _ = models.FindOne(users, &bson.M{"username": "admin"})
+	if roles := models.UserRoles(admin); fmt.Sprint(roles) != "[user]" {
+		t.Errorf("Expected the roles of the admin to be kept, got %v", roles)
+	}
+}
+
+func TestHooks(t *testing.T) {
+	setupTestApi(t)
+	userToken := login(t, "melissa", "raspberry")
+
+	calls := []string{}
+	record := func(name string) models.Hook {
+		return func(ctx *models.HookContext, doc bson.M) error {
+			calls = append(calls, name)
+			return nil
+		}
+	}
+	modelSettingsNote.Hooks = &models.Hooks{
+		BeforeCreate: []models.Hook{record("BeforeCreate"), func(ctx *models.HookContext, doc bson.M) error {
+			if doc["text"] == "forbidden" {
+				return models.NewHookError(http.StatusConflict, "no forbidden notes")
+			}
+			doc["secret"] = "set by hook"
+			return nil
+		}},
+		AfterCreate:  []models.Hook{record("AfterCreate")},
+		BeforeUpdate: []models.Hook{record("BeforeUpdate")},
+		AfterUpdate:  []models.Hook{record("AfterUpdate")},
+		BeforeDelete: []models.Hook{record("BeforeDelete")},
+		AfterDelete:  []models.Hook{record("AfterDelete")},
+		AfterRead:    []models.Hook{record("AfterRead")},
+	}
+	defer func() { modelSettingsNote.Hooks = nil }()
+
+	recorder := doRequest("POST", "/api/notes", userToken, bson.M{"text": "forbidden"})
+	if recorder.Code != http.StatusConflict {
+		t.Errorf("Expected hook to abort with 409, got %d", recorder.Code)
+	}
+
+	recorder = doRequest("POST", "/api/notes", userToken, bson.M{"text": "hello", "reads": 3})
+	if recorder.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected read-only field to be rejected, got %d", recorder.Code)
+	}
+
+	recorder = doRequest("POST", "/api/notes", userToken, bson.M{"text": "hello"})
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("Create failed with %d: %s", recorder.Code, recorder.Body.String())
+	}
+	note := decodeBody(t, recorder)["data"].(map[string]interface{})
+	if _, ok := attributes(note)["secret"]; ok {
+		t.Errorf("Expected hidden field not to be returned")
+	}
+	id := note["id"].(string)
+
+	stored, _ := models.FindId(testStore.C("notes"), id)
+	if (*stored)["secret"] != "set by hook" {
+		t.Errorf("Expected BeforeCreate to change the document, got %v", *stored)
+	}
+
+	doRequest("GET", "/api/notes/"+id, userToken, nil)
+	doRequest("PUT", "/api/notes/"+id, userToken, bson.M{"text": "hello again"})
+	doRequest("DELETE", "/api/notes/"+id, userToken, nil)
+
+	expected := []string{"BeforeCreate", "BeforeCreate", "AfterCreate", "AfterRead",
+		"BeforeUpdate", "AfterUpdate", "BeforeDelete", "AfterDelete"}
+	if len(calls) != len(expected) {
+		t.Fatalf("Expected hooks %v, got %v", expected, calls)
+	}
+	for i := range expected {
+		if calls[i] != expected[i] {
+			t.Errorf("Expected hooks %v, got %v", expected, calls)
+			break
+		}
+	}
+}
+
+func TestQueryParameters(t *testing.T) {
+	setupTestApi(t)
+	adminToken := login(t, "admin", "adminpass")
+	userToken := login(t, "melissa", "raspberry")
+
+	list := func(token, query string) []interface{} {
+		recorder := doRequest("GET", "/api/users/?"+query, token, nil)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("Listing with %q failed with %d: %s", query, recorder.Code, recorder.Body.String())
+		}
+		return decodeBody(t, recorder)["data"].([]interface{})
+	}
+
+	users := list(adminToken, "filter[username][regex]=^mel")
+	if len(users) != 1 || attributes(users[0])["username"] != "melissa" {
+		t.Errorf("Expected regex filter to match melissa, got %v", users)
+	}
+
+	users = list(adminToken, "filter[username][in]=admin,melissa&sort=-username")
+	if len(users) != 2 || attributes(users[0])["username"] != "melissa" {
+		t.Errorf("Expected descending sort, got %v", users)
+	}
+
+	users = list(adminToken, "filter[username]=admin&fields[users]=username")
+	if len(users) != 1 {
+		t.Fatalf("Expected one user, got %v", users)
+	}
+	if _, ok := attributes(users[0])["roles"]; ok {
+		t.Errorf("Expected fields[users] to drop roles, got %v", users[0])
+	}
+
+	if users := list(userToken, "filter[username]=admin"); len(users) != 0 {
+		t.Errorf("Expected filters not to widen the owner restriction, got %v", users)
+	}
+
+	recorder := doRequest("GET", "/api/users/?filter[username][in]=admin,melissa&page[limit]=1&page[after]=", adminToken, nil)
+	next := decodeBody(t, recorder)["links"].(map[string]interface{})["next"].(string)
+	recorder = doRequest("GET", next, adminToken, nil)
+	users = decodeBody(t, recorder)["data"].([]interface{})
+	if len(users) != 1 || attributes(users[0])["username"] != "melissa" {
+		t.Errorf("Expected the next link to page to melissa, got %v", users)
+	}
+	if recorder := doRequest("GET", "/api/pets/?page[after]="+next[strings.LastIndex(next, "=")+1:], adminToken, nil); recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected a users cursor to be rejected on pets, got %d", recorder.Code)
+	}
+
+	for _, query := range []string{"page[after]=forged", "filter[password]=x", "filter[username][where]=x", "sort=password",
+		"fields[users]=password", "filter[username][regex]=(", "page[limit]=1000"} {
+		if recorder := doRequest("GET", "/api/users/?"+query, adminToken, nil); recorder.Code != http.StatusBadRequest {
+			t.Errorf("Expected %q to be rejected, got %d", query, recorder.Code)
+		}
+	}
+}
+
+func TestJsonApi(t *testing.T) {
+	setupTestApi(t)
+	userToken := login(t, "melissa", "raspberry")
+
+	body := bson.M{"data": bson.M{"type": "notes", "attributes": bson.M{"text": "json:api"}}}
+	recorder := doRequestAs("POST", "/api/notes", userToken, MIME_JSONAPI, body)
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("Create failed with %d: %s", recorder.Code, recorder.Body.String())
+	}
+	if contentType := recorder.Header().Get("Content-Type"); contentType != MIME_JSONAPI {
+		t.Errorf("Expected a JSON:API response, got %q", contentType)
+	}
+	note := decodeBody(t, recorder)["data"].(map[string]interface{})
+	id := note["id"].(string)
+	if note["type"] != "notes" || attributes(note)["text"] != "json:api" || recorder.Header().Get("Location") != "/api/notes/"+id {
+		t.Errorf("Unexpected resource %v", note)
+	}
+	owner := note["relationships"].(map[string]interface{})["owner"].(map[string]interface{})["data"].(map[string]interface{})
+	if owner["type"] != "users" {
+		t.Errorf("Expected the owner relationship, got %v", note["relationships"])
+	}
+
+	body = bson.M{"data": bson.M{"type": "pets", "id": id, "attributes": bson.M{"text": "x"}}}
+	if recorder := doRequestAs("PUT", "/api/notes/"+id, userToken, MIME_JSONAPI, body); recorder.Code != http.StatusConflict {
+		t.Errorf("Expected a type mismatch to conflict, got %d", recorder.Code)
+	}
+
+	body = bson.M{"data": bson.M{"type": "notes", "id": id, "attributes": bson.M{"text": strings.Repeat("x", 141)}}}
+	recorder = doRequestAs("PUT", "/api/notes/"+id, userToken, MIME_JSONAPI, body)
+	errs := decodeBody(t, recorder)["errors"].([]interface{})
+	e := errs[0].(map[string]interface{})
+	if recorder.Code != http.StatusUnprocessableEntity || e["status"] != "422" ||
+		e["source"].(map[string]interface{})["pointer"] != "/data/attributes/text" {
+		t.Errorf("Expected a pointer to the invalid attribute, got %d %v", recorder.Code, errs)
+	}
+
+	if recorder := doRequestAs("GET", "/api/notes/"+id, userToken, MIME_JSONAPI+"; ext=bulk", nil); recorder.Code != http.StatusNotAcceptable {
+		t.Errorf("Expected media type parameters to be refused, got %d", recorder.Code)
+	}
+
+	if recorder := doRequest("DELETE", "/api/notes/"+id, userToken, nil); recorder.Code != http.StatusNoContent {
+		t.Errorf("Expected delete to respond 204, got %d", recorder.Code)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	setupTestApi(t)
+	userToken := login(t, "melissa", "raspberry")
+
+	tests := []struct {
+		method, path, token string
+		body                interface{}
+		status              int
+		code                string
+	}{
+		{"GET", "/api/notes/nothex", userToken, nil, http.StatusBadRequest, "invalid_id"},
+		{"GET", "/api/notes/" + bson.NewObjectId().Hex(), userToken, nil, http.StatusNotFound, "not_found"},
+		{"GET", "/api/notes/", "", nil, http.StatusUnauthorized, "missing_token"},
+		{"GET", "/api/notes/", "not.a.token", nil, http.StatusUnauthorized, "invalid_token"},
+		{"POST", "/api/auth/signup", "", bson.M{"username": "melissa", "password": "x", "email": "melissa@example.com"}, http.StatusConflict, "username_taken"},
+		{"POST", "/api/notes", userToken, bson.M{}, http.StatusUnprocessableEntity, "required"},
+		{"POST", "/api/auth/signup", "", bson.M{"username": "anonymous", "password": "x"}, http.StatusUnprocessableEntity, "required"},
+	}
+	for _, test := range tests {
+		recorder := doRequest(test.method, test.path, test.token, test.body)
+		if recorder.Code != test.status {
+			t.Errorf("%s %s: expected %d, got %d", test.method, test.path, test.status, recorder.Code)
+			continue
+		}
+		if code := errorCode(t, recorder); code != test.code {
+			t.Errorf("%s %s: expected code %s, got %s", test.method, test.path, test.code, code)
+		}
+	}
+
+	recorder := doRequest("POST", "/api/auth/signup", "", bson.M{"username": "newcomer", "password": "secret", "email": "newcomer@example.com"})
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Signup failed with %d: %s", recorder.Code, recorder.Body.String())
+	}
+	if token, _ := decodeBody(t, recorder)["meta"].(map[string]interface{})["token"].(string); token == "" {
+		t.Errorf("Expected signup to return a token")
+	}
+}
+
+func TestRequestLogFilter(t *testing.T) {
+	var out bytes.Buffer
+	container := restful.NewContainer()
+	container.Filter(newRequestLogFilter(logger.New(&out, logger.InfoLevel, logger.FormatJSON)))
+	ws := new(restful.WebService)
+	ws.Route(ws.GET("/ping").To(func(request *restful.Request, response *restful.Response) {
+		response.WriteHeader(http.StatusTeapot)
+	}))
+	container.Add(ws)
+
+	for _, test := range []struct{ sent, expected string }{
+		{"abc-123", "abc-123"},
+		{"not valid\nid", ""},
+		{"", ""},
+	} {
+		out.Reset()
+		req, _ := http.NewRequest("GET", "/ping", nil)
+		req.Header.Set(headerRequestId, test.sent)
+		recorder := httptest.NewRecorder()
+		container.ServeHTTP(recorder, req)
+
+		id := recorder.Header().Get(headerRequestId)
+		if id == "" || (test.expected != "" && id != test.expected) || (test.expected == "" && id == test.sent) {
+			t.Errorf("Sent request id %q, got %q", test.sent, id)
+		}
+		line := bson.M{}
+		if err := json.Unmarshal(out.Bytes(), &line); err != nil {
+			t.Fatalf("Invalid log line %q: %v", out.String(), err)
+		}
+		if line["request_id"] != id || line["path"] != "/ping" || line["status"] != float64(http.StatusTeapot) {
+			t.Errorf("Unexpected log line %v", line)
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	setupTestApi(t)
+
+	container := restful.NewContainer()
+	container.Filter(newMetricsFilter(container))
+	ws := new(restful.WebService)
+	ws.Route(ws.GET("/ping/{id}").To(func(request *restful.Request, response *restful.Response) {
+		response.WriteHeader(http.StatusTeapot)
+	}).Operation("ping"))
+	container.Add(ws)
+
+	requests := metrics.HTTPRequests.WithLabelValues("ping", "GET", "418")
+	before := testutil.ToFloat64(requests)
+	req, _ := http.NewRequest("GET", "/ping/1", nil)
+	container.ServeHTTP(httptest.NewRecorder(), req)
+	if count := testutil.ToFloat64(requests); count != before+1 {
+		t.Errorf("Expected the request to be counted under its operation, got %v", count-before)
+	}
+
+	failures := metrics.Logins.WithLabelValues(metrics.ResultFailure)
+	before = testutil.ToFloat64(failures)
+	doRequest("POST", "/api/auth/login", "", bson.M{"username": "melissa", "password": "wrong"})
+	if count := testutil.ToFloat64(failures); count != before+1 {
+		t.Errorf("Expected a failed login to be counted, got %v", count-before)
+	}
+
+	finds := metrics.DBDuration.WithLabelValues("users", "find_one")
+	before = float64(histogramCount(t, finds))
+	login(t, "melissa", "raspberry")
+	if count := float64(histogramCount(t, finds)); count <= before {
+		t.Errorf("Expected the user lookup to be timed")
+	}
+}
+
+func histogramCount(t *testing.T, observer prometheus.Observer) uint64 {
+	m := &dto.Metric{}
+	if err := observer.(prometheus.Metric).Write(m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestLogout(t *testing.T) {
+	setupTestApi(t)
+	adminToken := login(t, "admin", "adminpass")
+
+	recorder := doRequest("POST", "/api/auth/signup", "", bson.M{"username": "leaving", "password": "goodbye", "email": "leaving@example.com"})
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Signup failed with %d: %s", recorder.Code, recorder.Body.String())
+	}
+	id := decodeBody(t, recorder)["data"].(map[string]interface{})["id"].(string)
+
+	first, second := login(t, "leaving", "goodbye"), login(t, "leaving", "goodbye")
+	if recorder := doRequest("POST", "/api/auth/logout", first, nil); recorder.Code != http.StatusNoContent {
+		t.Fatalf("Logout failed with %d: %s", recorder.Code, recorder.Body.String())
+	}
+	if recorder := doRequest("GET", "/api/auth/test", first, nil); errorCode(t, recorder) != "token_revoked" {
+		t.Errorf("Expected the token to be revoked, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	if recorder := doRequest("GET", "/api/auth/test", second, nil); recorder.Code != http.StatusOK {
+		t.Errorf("Expected the other token to stay valid, got %d", recorder.Code)
+	}
+
+	// changing the password logs out everywhere
+	if recorder := doRequest("PUT", "/api/users/"+id, adminToken, bson.M{"password": "farewell"}); recorder.Code != http.StatusOK {
+		t.Fatalf("Update failed with %d: %s", recorder.Code, recorder.Body.String())
+	}
+	if recorder := doRequest("GET", "/api/auth/test", second, nil); errorCode(t, recorder) != "token_revoked" {
+		t.Errorf("Expected the password change to revoke the token, got %d", recorder.Code)
+	}
+
+	// so does a change of roles, whose tokens carry the old ones
+	promoted := login(t, "leaving", "farewell")
+	if recorder := doRequest("PUT", "/api/users/"+id, adminToken, bson.M{"roles": []string{"user", "editor"}}); recorder.Code != http.StatusOK {
+		t.Fatalf("Update failed with %d: %s", recorder.Code, recorder.Body.String())
+	}
+	if recorder := doRequest("GET", "/api/auth/test", promoted, nil); errorCode(t, recorder) != "token_revoked" {
+		t.Errorf("Expected the roles change to revoke the token, got %d", recorder.Code)
+	}
+
+	third := login(t, "leaving", "farewell")
+	if recorder := doRequest("POST", "/api/auth/logout?all=true", third, nil); recorder.Code != http.StatusNoContent {
+		t.Fatalf("Logout failed with %d: %s", recorder.Code, recorder.Body.String())
+	}
+	if recorder := doRequest("GET", "/api/auth/test", third, nil); errorCode(t, recorder) != "token_revoked" {
+		t.Errorf("Expected logging out of all devices to revoke the token, got %d", recorder.Code)
+	}
+	if recorder := doRequest("GET", "/api/auth/test", login(t, "leaving", "farewell"), nil); recorder.Code != http.StatusOK {
+		t.Errorf("Expected a new login to work, got %d", recorder.Code)
+	}
+
+	// deleted users can't log in again
+	if recorder := doRequest("DELETE", "/api/users/"+id, adminToken, nil); recorder.Code != http.StatusNoContent {
+		t.Fatalf("Delete failed with %d: %s", recorder.Code, recorder.Body.String())
+	}
+	if recorder := doRequest("POST", "/api/auth/login", "", bson.M{"username": "leaving", "password": "farewell"}); recorder.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a deleted user not to log in, got %d", recorder.Code)
+	}
+}
+
+func TestRefreshTokens(t *testing.T) {
+	setupTestApi(t)
+
+	loginTokens := func() (string, string) {
+		recorder := doRequest("POST", "/api/auth/login", "", bson.M{"username": "melissa", "password": "raspberry"})
+		meta := decodeBody(t, recorder)["meta"].(map[string]interface{})
+		refresh, _ := meta["refresh_token"].(string)
+		if refresh == "" {
+			t.Fatalf("Expected a refresh token, got %v", meta)
+		}
+		return meta["token"].(string), refresh
+	}
+	exchange := func(refresh string) *httptest.ResponseRecorder {
+		return doRequest("POST", "/api/auth/token", "", bson.M{"refresh_token": refresh})
+	}
+
+	_, refresh := loginTokens()
+	recorder := exchange(refresh)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Exchange failed with %d: %s", recorder.Code, recorder.Body.String())
+	}
+	meta := decodeBody(t, recorder)["meta"].(map[string]interface{})
+	rotated := meta["refresh_token"].(string)
+	if rotated == refresh {
+		t.Errorf("Expected the refresh token to be rotated")
+	}
+	if recorder := doRequest("GET", "/api/auth/test", meta["token"].(string), nil); recorder.Code != http.StatusOK {
+		t.Errorf("Expected the new access token to be valid, got %d", recorder.Code)
+	}
+
+	// reusing a rotated token revokes every token of the user
+	if recorder := exchange(refresh); errorCode(t, recorder) != "refresh_token_reused" {
+		t.Errorf("Expected the reuse to be detected, got %d", recorder.Code)
+	}
+	if recorder := exchange(rotated); errorCode(t, recorder) != "invalid_refresh_token" {
+		t.Errorf("Expected the family to be revoked, got %d", recorder.Code)
+	}
+	if recorder := doRequest("GET", "/api/auth/test", meta["token"].(string), nil); errorCode(t, recorder) != "token_revoked" {
+		t.Errorf("Expected the access token of the family to be revoked, got %d", recorder.Code)
+	}
+	if recorder := exchange("forged"); errorCode(t, recorder) != "invalid_refresh_token" {
+		t.Errorf("Expected an unknown token to be rejected, got %d", recorder.Code)
+	}
+
+	// logging out revokes the refresh token sent along
+	token, refresh := loginTokens()
+	if recorder := doRequest("POST", "/api/auth/logout", token, bson.M{"refresh_token": refresh}); recorder.Code != http.StatusNoContent {
+		t.Fatalf("Logout failed with %d: %s", recorder.Code, recorder.Body.String())
+	}
+	if recorder := exchange(refresh); errorCode(t, recorder) != "invalid_refresh_token" {
+		t.Errorf("Expected logout to revoke the refresh token, got %d", recorder.Code)
+	}
+
+	// the refresh token of another user is left untouched
+	_, refresh = loginTokens()
+	if recorder := doRequest("POST", "/api/auth/logout", login(t, "admin", "adminpass"), bson.M{"refresh_token": refresh}); recorder.Code != http.StatusNoContent {
+		t.Fatalf("Logout failed with %d: %s", recorder.Code, recorder.Body.String())
+	}
+	if recorder := exchange(refresh); recorder.Code != http.StatusOK {
+		t.Errorf("Expected the refresh token of another user to stay valid, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestJWKS(t *testing.T) {
+	setupTestApi(t)
+
+	recorder := doRequest("GET", "/.well-known/jwks.json", "", nil)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected the JWKS, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	if keys, ok := decodeBody(t, recorder)["keys"].([]interface{}); !ok || len(keys) != 0 {
+		t.Errorf("Expected the HMAC key not to be published, got %s", recorder.Body.String())
+	}
+}
+
+func TestLoginThrottle(t *testing.T) {
+	setupTestApi(t)
+	if recorder := doRequest("POST", "/api/auth/signup", "", bson.M{"username": "guessed", "password": "letmein", "email": "guessed@example.com"}); recorder.Code != http.StatusOK {
+		t.Fatalf("Signup failed with %d: %s", recorder.Code, recorder.Body.String())
+	}
+
+	// every attempt comes from another IP, so only the account is throttled
+	attempt := func(i int, password string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(bson.M{"username": "guessed", "password": password})
+		req, _ := http.NewRequest("POST", "/api/auth/login", bytes.NewReader(body))
+		req.Header.Set("Content-Type", restful.MIME_JSON)
+		req.RemoteAddr = fmt.Sprintf("198.51.100.%d:4242", i)
+		recorder := httptest.NewRecorder()
+		restful.DefaultContainer.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	for i := 0; i < config.Default().Login.FreeAttempts; i++ {
+		if recorder := attempt(i, "wrong"); recorder.Code != http.StatusUnauthorized {
+			t.Fatalf("Expected a failed login, got %d: %s", recorder.Code, recorder.Body.String())
+		}
+	}
+	recorder := attempt(100, "letmein")
+	if recorder.Code != http.StatusTooManyRequests || errorCode(t, recorder) != "too_many_attempts" {
+		t.Fatalf("Expected the account to be throttled, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	if retryAfter := recorder.Header().Get("Retry-After"); retryAfter != "1" {
+		t.Errorf("Expected to retry after a second, got %q", retryAfter)
+	}
+
+	usr, _ := models.FindOne(testStore.C("users"), &bson.M{"username": "guessed"})
+	if usr["failed_logins"] != config.Default().Login.FreeAttempts || usr["last_failed_login"] == nil {
+		t.Errorf("Expected the failures on the user, got %v", usr)
+	}
+
+	reasons := map[string]int{}
+	for _, failure := range testAudit.Failures {
+		if failure.Username == "guessed" {
+			reasons[failure.Reason]++
+		}
+	}
+	if reasons[gjwt.ReasonInvalidCredentials] != 5 || reasons[gjwt.ReasonThrottled] != 1 {
+		t.Errorf("Unexpected audit trail %v", reasons)
+	}
+}
+
+func TestUserAttempts(t *testing.T) {
+	collection := models.NewMemoryStore().C("users")
+	models.Create(collection, &bson.M{"username": "guessed"})
+	attempts := &userAttempts{collection: collection, window: time.Minute}
+
+	// concurrent failures are all counted
+	var wg sync.WaitGroup
+	now := time.Now()
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := attempts.Fail("guessed", now); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if current, _ := attempts.Attempts("guessed"); current.Failures != 20 {
+		t.Errorf("Expected 20 failures, got %+v", current)
+	}
+
+	if current, _ := attempts.Fail("guessed", now.Add(2*time.Minute)); current.Failures != 1 {
+		t.Errorf("Expected the count to restart out of the window, got %+v", current)
+	}
+	if current, err := attempts.Fail("unknown", now); err != nil || current.Failures != 0 {
+		t.Errorf("Expected no attempts for unknown users, got %+v, %v", current, err)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	setupTestApi(t)
+	adminToken := login(t, "admin", "adminpass")
+
+	for i := 0; i < 2; i++ {
+		recorder := doRequest("POST", "/api/drafts", adminToken, bson.M{"text": "draft"})
+		if recorder.Code != http.StatusCreated {
+			t.Fatalf("Expected the draft to be created, got %d: %s", recorder.Code, recorder.Body.String())
+		}
+		if limit, remaining := recorder.Header().Get("RateLimit-Limit"), recorder.Header().Get("RateLimit-Remaining"); limit != "2" || remaining != fmt.Sprint(1-i) {
+			t.Errorf("Unexpected rate limit headers %q %q", limit, remaining)
+		}
+	}
+	recorder := doRequest("POST", "/api/drafts", adminToken, bson.M{"text": "draft"})
+	if recorder.Code != http.StatusTooManyRequests || errorCode(t, recorder) != "rate_limited" {
+		t.Fatalf("Expected the third draft to be rate limited, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	if retryAfter := recorder.Header().Get("Retry-After"); retryAfter != "30" {
+		t.Errorf("Expected to retry after a token is back, got %q", retryAfter)
+	}
+	if reset := recorder.Header().Get("RateLimit-Reset"); reset != "60" {
+		t.Errorf("Expected the bucket to be full in a minute, got %q", reset)
+	}
+
+	// another user from the same IP has their own quota
+	recorder = doRequest("POST", "/api/drafts", login(t, "melissa", "raspberry"), bson.M{"text": "draft"})
+	if recorder.Code == http.StatusTooManyRequests || recorder.Header().Get("RateLimit-Remaining") != "1" {
+		t.Errorf("Expected another user to have their own bucket, got %d %q", recorder.Code, recorder.Header().Get("RateLimit-Remaining"))
+	}
+
+	// requests are counted per IP before their token is checked
+	req, _ := http.NewRequest("POST", "/api/drafts", strings.NewReader(`{"text": "draft"}`))
+	req.Header.Set("Content-Type", restful.MIME_JSON)
+	req.Header.Set("Authorization", "Bearer forged")
+	req.RemoteAddr = "203.0.113.7:4242"
+	recorder = httptest.NewRecorder()
+	restful.DefaultContainer.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusUnauthorized || recorder.Header().Get("RateLimit-Remaining") != "599" {
+		t.Errorf("Expected a bad token to be counted, got %d %q", recorder.Code, recorder.Header().Get("RateLimit-Remaining"))
+	}
+
+	// reads have the default limit, in their own bucket
+	recorder = doRequest("GET", "/api/drafts/", adminToken, nil)
+	if recorder.Code != http.StatusOK || recorder.Header().Get("RateLimit-Limit") != "600" {
+		t.Errorf("Expected the default limit on reads, got %d %q", recorder.Code, recorder.Header().Get("RateLimit-Limit"))
+	}
+}
+
+func TestEmailVerification(t *testing.T) {
+	setupTestApi(t)
+	recorder := doRequest("POST", "/api/auth/signup", "", bson.M{"username": "unverified", "password": "checkme", "email": "unverified@example.com"})
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Signup failed with %d: %s", recorder.Code, recorder.Body.String())
+	}
+	if verified, _ := attributes(decodeBody(t, recorder)["data"])["email_verified"].(bool); verified {
+		t.Errorf("Expected a new email address to be unverified")
+	}
+
+	mail := testMails.last("unverified@example.com", verificationMail.subject)
+	if mail == nil {
+		t.Fatalf("Expected a verification mail, got %v", mail)
+	}
+	link := regexp.MustCompile(`http://\S+`).FindString(mail["message"].(string))
+	if !strings.HasPrefix(link, "http://localhost:8080/api/auth/verify?token=") {
+		t.Fatalf("Expected a verification link, got %q", mail["message"])
+	}
+
+	// unverified accounts can log in until verification is required
+	login(t, "unverified", "checkme")
+	gJwtService.VerifiedFunc = emailVerified
+	defer func() { gJwtService.VerifiedFunc = nil }()
+	recorder = doRequest("POST", "/api/auth/login", "", bson.M{"username": "unverified", "password": "checkme"})
+	if recorder.Code != http.StatusForbidden || errorCode(t, recorder) != "email_not_verified" {
+		t.Fatalf("Expected the login to be refused, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+
+	path := strings.TrimPrefix(link, "http://localhost:8080")
+	recorder = doRequest("GET", path, "", nil)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Verification failed with %d: %s", recorder.Code, recorder.Body.String())
+	}
+	if verified, _ := attributes(decodeBody(t, recorder)["data"])["email_verified"].(bool); !verified {
+		t.Errorf("Expected the email address to be verified, got %s", recorder.Body.String())
+	}
+	login(t, "unverified", "checkme")
+
+	recorder = doRequest("GET", path, "", nil)
+	if recorder.Code != http.StatusBadRequest || errorCode(t, recorder) != "invalid_verification_token" {
+		t.Errorf("Expected the link to work once, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestUniqueEmail(t *testing.T) {
+	setupTestApi(t)
+	recorder := doRequest("POST", "/api/auth/signup", "", bson.M{"username": "original", "password": "checkme", "email": "original@example.com"})
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Signup failed with %d: %s", recorder.Code, recorder.Body.String())
+	}
+
+	recorder = doRequest("POST", "/api/auth/signup", "", bson.M{"username": "impostor", "password": "checkme", "email": "original@example.com"})
+	if recorder.Code != http.StatusConflict || errorCode(t, recorder) != "email_taken" {
+		t.Fatalf("Expected the address to be taken, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	recorder = doRequest("POST", "/api/auth/signup", "", bson.M{"username": "impostor", "password": "checkme", "email": "impostor@example.com"})
+	id := decodeBody(t, recorder)["data"].(map[string]interface{})["id"].(string)
+	adminToken := login(t, "admin", "adminpass")
+	recorder = doRequest("PUT", "/api/users/"+id, adminToken, bson.M{"email": "original@example.com"})
+	if recorder.Code != http.StatusConflict || errorCode(t, recorder) != "email_taken" {
+		t.Errorf("Expected the address to be taken, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	if recorder := doRequest("PUT", "/api/users/"+id, adminToken, bson.M{"email": "impostor@example.com"}); recorder.Code != http.StatusOK {
+		t.Errorf("Expected users to keep their own address, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestPasswordReset(t *testing.T) {
+	setupTestApi(t)
+	recorder := doRequest("POST", "/api/auth/signup", "", bson.M{"username": "forgetful", "password": "first", "email": "forgetful@example.com"})
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Signup failed with %d: %s", recorder.Code, recorder.Body.String())
+	}
+	token := login(t, "forgetful", "first")
+
+	// unknown addresses get the same answer
+	for _, email := range []string{"nobody@example.com", "forgetful@example.com"} {
+		recorder := doRequest("POST", "/api/auth/password/forgot", "", bson.M{"email": email})
+		if recorder.Code != http.StatusAccepted || recorder.Body.Len() != 0 {
+			t.Errorf("Expected %s to be accepted, got %d: %s", email, recorder.Code, recorder.Body.String())
+		}
+	}
+
+	link := resetLink(t, "forgetful@example.com", nil)
+	if testMails.last("nobody@example.com", passwordResetMail.subject) != nil {
+		t.Errorf("Expected no mail to unknown addresses")
+	}
+	reset := bson.M{"token": link.Query().Get("token"), "password": "second"}
+
+	// someone guessing the password locked the account
+	id := decodeBody(t, recorder)["data"].(map[string]interface{})["id"].(string)
+	models.Update(testStore.C("users"), id, &bson.M{"failed_logins": 3, "locked_until": time.Now().Add(time.Hour)})
+
+	if recorder := doRequest("POST", "/api/auth/password/reset", "", bson.M{"token": reset["token"]}); recorder.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected a password to be required, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	if recorder := doRequest("POST", "/api/auth/password/reset", "", reset); recorder.Code != http.StatusNoContent {
+		t.Fatalf("Reset failed with %d: %s", recorder.Code, recorder.Body.String())
+	}
+	if usr, _ := models.FindId(testStore.C("users"), id); (*usr)["failed_logins"] != 0 || (*usr)["locked_until"] != nil {
+		t.Errorf("Expected the reset to lift the lockout, got %v", *usr)
+	}
+
+	if recorder := doRequest("GET", "/api/auth/test", token, nil); recorder.Code != http.StatusUnauthorized || errorCode(t, recorder) != "token_revoked" {
+		t.Errorf("Expected the reset to revoke the tokens, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	if recorder := doRequest("POST", "/api/auth/login", "", bson.M{"username": "forgetful", "password": "first"}); recorder.Code != http.StatusUnauthorized {
+		t.Errorf("Expected the old password to be refused, got %d", recorder.Code)
+	}
+	login(t, "forgetful", "second")
+
+	recorder = doRequest("POST", "/api/auth/password/reset", "", reset)
+	if recorder.Code != http.StatusBadRequest || errorCode(t, recorder) != "invalid_reset_token" {
+		t.Errorf("Expected the token to work once, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+
+	// deleted users can't come back through a reset
+	doRequest("POST", "/api/auth/password/forgot", "", bson.M{"email": "forgetful@example.com"})
+	link = resetLink(t, "forgetful@example.com", link)
+	if recorder := doRequest("DELETE", "/api/users/"+id, login(t, "admin", "adminpass"), nil); recorder.Code != http.StatusNoContent {
+		t.Fatalf("Delete failed with %d: %s", recorder.Code, recorder.Body.String())
+	}
+	recorder = doRequest("POST", "/api/auth/password/reset", "", bson.M{"token": link.Query().Get("token"), "password": "third"})
+	if recorder.Code != http.StatusBadRequest || errorCode(t, recorder) != "invalid_reset_token" {
+		t.Errorf("Expected a deleted user not to be reset, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+}
+
+// resetLink waits for a password reset mail to email, sent in the
+// background, with another link than previous, and returns its link.
+func resetLink(t *testing.T, email string, previous *url.URL) *url.URL {
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		mail := testMails.last(email, passwordResetMail.subject)
+		if mail == nil {
+			continue
+		}
+		link, err := url.Parse(regexp.MustCompile(`http://\S+`).FindString(mail["message"].(string)))
+		if err != nil || link.Path != "/reset-password" {
+			t.Fatalf("Expected a link to the reset page, got %q", mail["message"])
+		}
+		if previous == nil || link.String() != previous.String() {
+			return link
+		}
+	}
+	t.Fatalf("Expected a password reset mail")
+	return nil
+}
@@ -0,0 +1,114 @@
+package api
+
+import (
+	"errors"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+
+	"../gjwt"
+	"../models"
+)
+
+var errAttemptsContention = errors.New("the failed logins of the account keep changing")
+
+// userAttempts keeps the failed logins of the accounts on the user documents,
+// in failed_logins, last_failed_login and locked_until. Unknown usernames have
+// no attempts: they are only throttled per client IP. It is made for each
+// login request, with the collection of the request.
+type userAttempts struct {
+	collection models.Collection
+	window     time.Duration
+}
+
+// accountQuery selects the user of a username, with more conditions.
+func accountQuery(username string, conditions bson.M) *bson.M {
+	query := bson.M{"username": username, "deleted_at": bson.M{"$exists": false}}
+	for key, value := range conditions {
+		query[key] = value
+	}
+	return &query
+}
+
+func (ua *userAttempts) find(username string) (bson.M, error) {
+	usr, err := models.FindOne(ua.collection, accountQuery(username, nil))
+	if err == models.ErrNotFound {
+		return nil, nil
+	}
+	return usr, err
+}
+
+func (ua *userAttempts) Attempts(username string) (gjwt.Attempts, error) {
+	usr, err := ua.find(username)
+	if usr == nil {
+		return gjwt.Attempts{}, err
+	}
+	return ua.attempts(usr, time.Now()), nil
+}
+
+// attempts reads the counters of the user, forgetting the failures out of the
+// window.
+func (ua *userAttempts) attempts(usr bson.M, now time.Time) gjwt.Attempts {
+	attempts := gjwt.Attempts{}
+	switch failures := usr["failed_logins"].(type) {
+	case int:
+		attempts.Failures = failures
+	case int64:
+		attempts.Failures = int(failures)
+	case float64:
+		attempts.Failures = int(failures)
+	}
+	attempts.LastFailure, _ = usr["last_failed_login"].(time.Time)
+	attempts.LockedUntil, _ = usr["locked_until"].(time.Time)
+	if now.Sub(attempts.LastFailure) > ua.window {
+		attempts.Failures = 0
+	}
+	return attempts
+}
+
+// Fail increments the count atomically, so that concurrent failures are all
+// counted, restarting it when the last failure is out of the window.
+func (ua *userAttempts) Fail(username string, t time.Time) (gjwt.Attempts, error) {
+	recent := bson.M{"$gte": t.Add(-ua.window)}
+	for i := 0; i < 3; i++ {
+		usr, err := models.Apply(ua.collection, accountQuery(username, bson.M{"last_failed_login": recent}),
+			&bson.M{"$inc": bson.M{"failed_logins": 1}, "$set": bson.M{"last_failed_login": t}})
+		if err != models.ErrNotFound {
+			return ua.attempts(usr, t), err
+		}
+
+		// no failure in the window yet: start counting, unless a concurrent
+		// failure just did
+		stale := bson.M{"$or": []bson.M{
+			{"last_failed_login": bson.M{"$exists": false}},
+			{"last_failed_login": bson.M{"$lt": t.Add(-ua.window)}}}}
+		usr, err = models.Apply(ua.collection, accountQuery(username, stale),
+			&bson.M{"$set": bson.M{"failed_logins": 1, "last_failed_login": t}})
+		if err != models.ErrNotFound {
+			return ua.attempts(usr, t), err
+		}
+		if usr, err := ua.find(username); usr == nil {
+			return gjwt.Attempts{}, err
+		}
+	}
+	return gjwt.Attempts{}, errAttemptsContention
+}
+
+func (ua *userAttempts) Lock(username string, until time.Time) error {
+	_, err := models.Apply(ua.collection, accountQuery(username, nil),
+		&bson.M{"$set": bson.M{"failed_logins": 0, "locked_until": until}})
+	if err == models.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+func (ua *userAttempts) Reset(username string) error {
+	// spare a write on every login
+	_, err := models.Apply(ua.collection, accountQuery(username, bson.M{"failed_logins": bson.M{"$gt": 0}}),
+		&bson.M{"$set": bson.M{"failed_logins": 0}})
+	if err == models.ErrNotFound {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,90 @@
+package api
+
+import (
+	"net/http"
+
+	"gopkg.in/mgo.v2/bson"
+
+	"../models"
+)
+
+// userHooks hold the users specific logic of the generic handlers.
+var userHooks = &models.Hooks{
+	BeforeCreate: []models.Hook{hashPasswordHook, uniqueEmailHook},
+	BeforeUpdate: []models.Hook{hashPasswordHook, uniqueEmailHook, emailChangedHook},
+	AfterUpdate:  []models.Hook{passwordChangedHook, rolesChangedHook},
+	AfterDelete:  []models.Hook{revokeTokensHook},
+}
+
+// hashPasswordHook replaces the plain password of the document by its hash.
+func hashPasswordHook(ctx *models.HookContext, doc bson.M) error {
+	password, ok := doc["password"]
+	if !ok {
+		return nil
+	}
+	plain, ok := password.(string)
+	if !ok {
+		return models.NewHookError(http.StatusBadRequest, "password must be a string")
+	}
+	hash, err := GenPasswordHash(plain)
+	if err != nil {
+		return err
+	}
+	doc["password"] = hash
+	return nil
+}
+
+// uniqueEmailHook refuses an email address of another user.
+func uniqueEmailHook(ctx *models.HookContext, doc bson.M) error {
+	email, ok := doc["email"].(string)
+	if !ok || email == "" {
+		return nil
+	}
+	query := bson.M{"email": email}
+	if bson.IsObjectIdHex(ctx.Id) {
+		query["_id"] = bson.M{"$ne": bson.ObjectIdHex(ctx.Id)}
+	}
+	if models.IsExists(ctx.Collection, &query) {
+		return errEmailTaken
+	}
+	return nil
+}
+
+// emailChangedHook marks a new email address unverified.
+func emailChangedHook(ctx *models.HookContext, doc bson.M) error {
+	email, ok := doc["email"]
+	if !ok {
+		return nil
+	}
+	usr, err := models.FindId(ctx.Collection, ctx.Id)
+	if err != nil {
+		return err
+	}
+	if (*usr)["email"] != email {
+		doc["email_verified"] = false
+	}
+	return nil
+}
+
+// revokeTokensHook logs the user out of every device.
+func revokeTokensHook(ctx *models.HookContext, doc bson.M) error {
+	return gJwtService.RevokeUser(ctx.Id)
+}
+
+func passwordChangedHook(ctx *models.HookContext, doc bson.M) error {
+	if _, ok := doc["password"]; !ok {
+		return nil
+	}
+	return revokeTokensHook(ctx, doc)
+}
+
+// rolesChangedHook logs the user out, so that tokens carrying the old roles or
+// permissions stop working.
+func rolesChangedHook(ctx *models.HookContext, doc bson.M) error {
+	_, roles := doc["roles"]
+	_, permissions := doc["permissions"]
+	if !roles && !permissions {
+		return nil
+	}
+	return revokeTokensHook(ctx, doc)
+}
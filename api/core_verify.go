@@ -0,0 +1,93 @@
+package api
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/emicklei/go-restful"
+
+	"../apierror"
+	"../gjwt"
+	"../models"
+)
+
+var (
+	errEmailRequired = models.ValidationErrors{{Field: "email", Code: "required", Message: "email is required"}}.APIError()
+
+	errInvalidVerification = apierror.ErrBadRequest.WithCode("invalid_verification_token").
+				WithMessage("Verification link is invalid or has expired")
+)
+
+// sendVerification mails the user a link to verify their email address.
+func (as *ApiService) sendVerification(usr bson.M) error {
+	base := strings.TrimRight(as.config.Mail.BaseUrl, "/") + "/api/auth/verify"
+	return as.mailToken(usr, gjwt.PurposeVerifyEmail, as.config.Account.VerificationTimeout.Duration, verificationMail, base)
+}
+
+// mailToken mails the user a one-time token for the purpose, as the token
+// query parameter of a link to base. The tokens sent before for the same
+// purpose stop working.
+func (as *ApiService) mailToken(usr bson.M, purpose string, timeout time.Duration, tmpl mailTemplate, base string) error {
+	userId := usr["_id"].(bson.ObjectId).Hex()
+	email, _ := usr["email"].(string)
+	if err := as.oneTimeTokens.Revoke(purpose, userId); err != nil {
+		return err
+	}
+	token, record := gjwt.NewOneTimeToken(purpose, userId, email, timeout)
+	if err := as.oneTimeTokens.Save(record); err != nil {
+		return err
+	}
+	return as.mailer.SendTemplate(email, tmpl, bson.M{
+		"Username":  usr["username"],
+		"Link":      base + "?" + url.Values{"token": {token}}.Encode(),
+		"ExpiresAt": record.ExpiresAt})
+}
+
+// GET http://localhost:8080/api/auth/verify?token=TOKEN
+//
+// verifyEmail marks the email address of the user verified. The token only
+// works once, and only for the address it was sent to.
+func (as *ApiService) verifyEmail(request *restful.Request, response *restful.Response) {
+	token := request.QueryParameter("token")
+	if token == "" {
+		writeAPIError(response, errInvalidVerification)
+		return
+	}
+	stored, err := as.oneTimeTokens.Use(gjwt.PurposeVerifyEmail, gjwt.HashOneTimeToken(token))
+	if err != nil {
+		writeAPIError(response, apierror.ErrInternal.WithCause(err))
+		return
+	}
+	if stored == nil || stored.ExpiresAt.Before(time.Now()) {
+		writeAPIError(response, errInvalidVerification)
+		return
+	}
+
+	usr, err := models.FindId(as.C(request), stored.UserId)
+	if err == models.ErrNotFound || (err == nil && (*usr)["email"] != stored.Email) {
+		writeAPIError(response, errInvalidVerification)
+		return
+	}
+	if err == nil {
+		err = models.Update(as.C(request), stored.UserId, &bson.M{"email_verified": true})
+	}
+	if err != nil {
+		writeAPIError(response, err)
+		return
+	}
+
+	(*usr)["email_verified"] = true
+	as.settings.Schema.Hide(*usr)
+	writeDocument(response, http.StatusOK, &Document{Data: as.resource(*usr)})
+}
+
+// emailVerified tells the JwtService whether the user may log in, when
+// verified email addresses are required.
+func emailVerified(usr bson.M) bool {
+	verified, _ := usr["email_verified"].(bool)
+	return verified
+}
@@ -1,12 +1,27 @@
 package api
 
 import (
+	"../config"
+	"../logger"
 	"../models"
+	"../ratelimit"
 )
 
-func registerAll() {
+// resources lists the collections served by the generic CRUD handlers.
+var resources = []*models.ModelSettings{
+	models.ModelSettingsUser,
+	models.ModelSettingsPet,
+}
+
+func registerAll(store models.Store, auth authStores, rateLimits ratelimit.Store, cfg *config.Config, log *logger.Logger) {
+
+	gLogger = log
+	gRateLimits = rateLimits
+	models.ModelSettingsUser.Hooks = userHooks
 
-	NewAuthService()
-	NewApiService(models.ModelSettingsUser)
+	NewAuthService(store, auth, cfg, log)
+	for _, settings := range resources {
+		NewApiService(store, cfg, log, settings)
+	}
 
 }
@@ -0,0 +1,116 @@
+// Package apierror defines the errors the API reports to its clients.
+//
+// Every layer (models, gjwt, api) returns *Error values, or errors From can
+// translate, and a single writer in the api package turns them into
+// responses, so a given failure always gets the same status and code.
+package apierror
+
+import (
+	"net/http"
+
+	"gopkg.in/mgo.v2"
+)
+
+// Error is an error with the HTTP status and the stable, machine readable
+// code clients see. Cause is the underlying error: it is logged but never
+// sent to clients.
+type Error struct {
+	Status  int
+	Code    string
+	Message string
+	Details []Detail
+	Cause   error
+}
+
+// Detail locates one of several problems of a request, like a field failing
+// validation.
+type Detail struct {
+	Code    string
+	Message string
+	// Pointer is a JSON pointer into the request body, Parameter the name
+	// of a query string parameter.
+	Pointer   string
+	Parameter string
+}
+
+var (
+	ErrBadRequest   = New(http.StatusBadRequest, "bad_request", "Bad request")
+	ErrUnauthorized = New(http.StatusUnauthorized, "unauthorized", "Not authorized")
+	ErrForbidden    = New(http.StatusForbidden, "forbidden", "Forbidden")
+	ErrNotFound     = New(http.StatusNotFound, "not_found", "Not found")
+	ErrConflict     = New(http.StatusConflict, "conflict", "Conflict")
+	ErrInvalid      = New(http.StatusUnprocessableEntity, "validation_failed", "Validation failed")
+	ErrInternal     = New(http.StatusInternalServerError, "internal_error", "Internal server error")
+)
+
+func New(status int, code, message string) *Error {
+	return &Error{Status: status, Code: code, Message: message}
+}
+
+func (e *Error) Error() string {
+	if e.Cause != nil {
+		return e.Message + ": " + e.Cause.Error()
+	}
+	return e.Message
+}
+
+// The With methods return a copy, so the package level errors can be used as
+// templates.
+
+func (e *Error) WithCode(code string) *Error {
+	c := *e
+	c.Code = code
+	return &c
+}
+
+func (e *Error) WithMessage(message string) *Error {
+	c := *e
+	c.Message = message
+	return &c
+}
+
+func (e *Error) WithDetails(details ...Detail) *Error {
+	c := *e
+	c.Details = append(append([]Detail{}, e.Details...), details...)
+	return &c
+}
+
+func (e *Error) WithCause(cause error) *Error {
+	c := *e
+	c.Cause = cause
+	return &c
+}
+
+// Is tells whether err is an *Error with the same code as e.
+func (e *Error) Is(err error) bool {
+	other, ok := err.(*Error)
+	return ok && other.Code == e.Code
+}
+
+// Converter is implemented by errors that know their API error, like the
+// validation errors of the models package.
+type Converter interface {
+	APIError() *Error
+}
+
+// From returns the API error for err: err itself when it is an *Error, the
+// matching error for Mongo's not found and duplicate key errors, and an
+// internal error, keeping err as the cause, otherwise. It returns nil for a
+// nil err.
+func From(err error) *Error {
+	switch e := err.(type) {
+	case nil:
+		return nil
+	case *Error:
+		return e
+	case Converter:
+		return e.APIError()
+	}
+	if err == mgo.ErrNotFound {
+		return ErrNotFound.WithCause(err)
+	}
+	if mgo.IsDup(err) {
+		return ErrConflict.WithCode("duplicate_key").WithMessage("Already exists").WithCause(err)
+	}
+	return ErrInternal.WithCause(err)
+}
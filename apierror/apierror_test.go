@@ -0,0 +1,48 @@
+package apierror
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"gopkg.in/mgo.v2"
+)
+
+type converted struct{}
+
+func (converted) Error() string    { return "converted" }
+func (converted) APIError() *Error { return ErrForbidden }
+
+func TestFrom(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+		code   string
+	}{
+		{mgo.ErrNotFound, http.StatusNotFound, "not_found"},
+		{&mgo.LastError{Code: 11000, Err: "E11000 duplicate key"}, http.StatusConflict, "duplicate_key"},
+		{errors.New("connection reset"), http.StatusInternalServerError, "internal_error"},
+		{ErrNotFound.WithCode("user_not_found"), http.StatusNotFound, "user_not_found"},
+		{converted{}, http.StatusForbidden, "forbidden"},
+	}
+	for _, test := range tests {
+		e := From(test.err)
+		if e.Status != test.status || e.Code != test.code {
+			t.Errorf("From(%v) = %d %s, expected %d %s", test.err, e.Status, e.Code, test.status, test.code)
+		}
+	}
+
+	if From(nil) != nil {
+		t.Errorf("Expected From(nil) to be nil")
+	}
+
+	cause := errors.New("connection reset")
+	if e := From(cause); e.Cause != cause || e.Message != "Internal server error" {
+		t.Errorf("Expected the cause to be kept out of the message, got %#v", e)
+	}
+
+	e := ErrNotFound.WithMessage("User could not be found.")
+	if ErrNotFound.Message != "Not found" || !ErrNotFound.Is(e) {
+		t.Errorf("Expected With methods to copy the error")
+	}
+}
@@ -0,0 +1,561 @@
+// Package config loads the server, database, JWT and mailer settings.
+//
+// Settings are resolved in this order, each step overriding the previous one:
+//
+//	1. built-in defaults (see Default)
+//	2. the config file given by -config or CONFIG_FILE (.yaml, .yml or .json)
+//	3. environment variables (MONGODB_ADDRESS, JWT_KEY, ...)
+//	4. command-line flags (-listen, -jwt-key, ...)
+//
+// The result is validated before the server starts.
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+type Config struct {
+	Server    ServerConfig    `json:"server" yaml:"server"`
+	Database  DatabaseConfig  `json:"database" yaml:"database"`
+	Jwt       JwtConfig       `json:"jwt" yaml:"jwt"`
+	Swagger   SwaggerConfig   `json:"swagger" yaml:"swagger"`
+	Cors      CorsConfig      `json:"cors" yaml:"cors"`
+	Mail      MailConfig      `json:"mail" yaml:"mail"`
+	Log       LogConfig       `json:"log" yaml:"log"`
+	Login     LoginConfig     `json:"login" yaml:"login"`
+	RateLimit RateLimitConfig `json:"rate_limit" yaml:"rate_limit"`
+	Account   AccountConfig   `json:"account" yaml:"account"`
+}
+
+type ServerConfig struct {
+	Listen string `json:"listen" yaml:"listen"`
+	// CursorKey signs the page[after] and page[before] cursors. When empty a
+	// random key is used and cursors do not survive a restart.
+	CursorKey string `json:"cursor_key" yaml:"cursor_key"`
+
+	ReadTimeout  Duration `json:"read_timeout" yaml:"read_timeout"`
+	WriteTimeout Duration `json:"write_timeout" yaml:"write_timeout"`
+	IdleTimeout  Duration `json:"idle_timeout" yaml:"idle_timeout"`
+	// On SIGINT or SIGTERM the readiness probe fails for DrainPeriod, so load
+	// balancers stop sending requests, then in-flight requests get up to
+	// ShutdownTimeout to complete.
+	DrainPeriod     Duration `json:"drain_period" yaml:"drain_period"`
+	ShutdownTimeout Duration `json:"shutdown_timeout" yaml:"shutdown_timeout"`
+}
+
+type DatabaseConfig struct {
+	Address string `json:"address" yaml:"address"`
+	Name    string `json:"name" yaml:"name"`
+
+	DialTimeout Duration `json:"dial_timeout" yaml:"dial_timeout"`
+	// DialRetries and OperationRetries are the number of retries after a
+	// connection failure, waiting RetryBackoff and doubling it each time.
+	DialRetries      int      `json:"dial_retries" yaml:"dial_retries"`
+	OperationRetries int      `json:"operation_retries" yaml:"operation_retries"`
+	RetryBackoff     Duration `json:"retry_backoff" yaml:"retry_backoff"`
+}
+
+type JwtConfig struct {
+	Realm            string   `json:"realm" yaml:"realm"`
+	SigningAlgorithm string   `json:"signing_algorithm" yaml:"signing_algorithm"`
+	Key              string   `json:"key" yaml:"key"`
+	Timeout          Duration `json:"timeout" yaml:"timeout"`
+	// Issuer and Audience are the iss and aud of the tokens, checked when
+	// they are verified; tokens are accepted for any of the audiences.
+	// Leeway is the clock skew tolerated on exp, nbf and iat.
+	Issuer   string   `json:"issuer" yaml:"issuer"`
+	Audience []string `json:"audience" yaml:"audience"`
+	Leeway   Duration `json:"leeway" yaml:"leeway"`
+	// MaxRefresh enables the deprecated GET /api/auth/refresh, which
+	// re-signs access tokens; 0 disables it. Clients should exchange the
+	// refresh tokens, valid for RefreshTimeout, instead.
+	MaxRefresh     Duration `json:"max_refresh" yaml:"max_refresh"`
+	RefreshTimeout Duration `json:"refresh_timeout" yaml:"refresh_timeout"`
+	// Keys sign tokens with RSA, ECDSA or Ed25519 keys, published at
+	// /.well-known/jwks.json. The latest key whose not_before has passed
+	// signs; a replaced key still verifies tokens for KeyGracePeriod. Key, if
+	// set, signs until the first of them starts.
+	Keys           []KeyConfig `json:"keys" yaml:"keys"`
+	KeyGracePeriod Duration    `json:"key_grace_period" yaml:"key_grace_period"`
+}
+
+type KeyConfig struct {
+	// Id is the kid header of the tokens signed with the key.
+	Id        string `json:"id" yaml:"id"`
+	Algorithm string `json:"algorithm" yaml:"algorithm"`
+	// File is a PEM private key, or a public key to only verify tokens.
+	File      string    `json:"file" yaml:"file"`
+	NotBefore time.Time `json:"not_before" yaml:"not_before"`
+}
+
+// LoginConfig throttles password guessing: past FreeAttempts failed logins in
+// a row, from a client IP or for an account, each failure doubles the wait
+// before the next attempt, from BaseDelay up to MaxDelay. LockoutThreshold
+// failures lock the account for LockoutDuration, 0 never locks. Failures are
+// forgotten after Window, the audit trail after AuditRetention.
+type LoginConfig struct {
+	FreeAttempts     int      `json:"free_attempts" yaml:"free_attempts"`
+	BaseDelay        Duration `json:"base_delay" yaml:"base_delay"`
+	MaxDelay         Duration `json:"max_delay" yaml:"max_delay"`
+	LockoutThreshold int      `json:"lockout_threshold" yaml:"lockout_threshold"`
+	LockoutDuration  Duration `json:"lockout_duration" yaml:"lockout_duration"`
+	Window           Duration `json:"window" yaml:"window"`
+	AuditRetention   Duration `json:"audit_retention" yaml:"audit_retention"`
+}
+
+// RateLimitConfig lets each user, and each client IP, make up to Requests
+// requests per Period on the API, and each client IP AuthRequests on the auth
+// routes; 0 disables the limit. Store is memory, or mongo to share the limits
+// between the instances. Collections can override the limit of the users per
+// action.
+type RateLimitConfig struct {
+	Requests     int      `json:"requests" yaml:"requests"`
+	AuthRequests int      `json:"auth_requests" yaml:"auth_requests"`
+	Period       Duration `json:"period" yaml:"period"`
+	Store        string   `json:"store" yaml:"store"`
+}
+
+type SwaggerConfig struct {
+	WebServicesUrl  string `json:"web_services_url" yaml:"web_services_url"`
+	ApiPath         string `json:"api_path" yaml:"api_path"`
+	SwaggerPath     string `json:"swagger_path" yaml:"swagger_path"`
+	SwaggerFilePath string `json:"swagger_file_path" yaml:"swagger_file_path"`
+}
+
+type CorsConfig struct {
+	// AllowedOrigins lists the origins echoed back in Access-Control-Allow-Origin.
+	// When empty the origin is derived from the request Host, as before.
+	AllowedOrigins []string `json:"allowed_origins" yaml:"allowed_origins"`
+	AllowedMethods []string `json:"allowed_methods" yaml:"allowed_methods"`
+	AllowedHeaders []string `json:"allowed_headers" yaml:"allowed_headers"`
+	MaxAge         int      `json:"max_age" yaml:"max_age"`
+}
+
+type MailConfig struct {
+	QueueUrl string `json:"queue_url" yaml:"queue_url"`
+	// From is the sender of the mails to the users, and BaseUrl the public
+	// URL of the API the links in them point to.
+	From    string `json:"from" yaml:"from"`
+	BaseUrl string `json:"base_url" yaml:"base_url"`
+}
+
+// AccountConfig is about the accounts of the users: signup mails a link to
+// verify the email address, valid for VerificationTimeout. With
+// RequireVerifiedEmail users can't log in until they followed it.
+// Users who forgot their password are mailed a link to ResetUrl, the page of
+// the client choosing a new one, with a token valid for ResetTimeout.
+type AccountConfig struct {
+	RequireVerifiedEmail bool     `json:"require_verified_email" yaml:"require_verified_email"`
+	VerificationTimeout  Duration `json:"verification_timeout" yaml:"verification_timeout"`
+	ResetUrl             string   `json:"reset_url" yaml:"reset_url"`
+	ResetTimeout         Duration `json:"reset_timeout" yaml:"reset_timeout"`
+}
+
+type LogConfig struct {
+	// Level is one of debug, info, warn and error.
+	Level string `json:"level" yaml:"level"`
+	// Format is json or logfmt.
+	Format string `json:"format" yaml:"format"`
+}
+
+// Duration is a time.Duration written as "1h30m" in config files.
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	return d.Set(s)
+}
+
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	return d.Set(s)
+}
+
+func (d *Duration) Set(s string) error {
+	duration, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = duration
+	return nil
+}
+
+func Default() *Config {
+	return &Config{
+		Server: ServerConfig{
+			Listen:          ":8080",
+			ReadTimeout:     Duration{15 * time.Second},
+			WriteTimeout:    Duration{30 * time.Second},
+			IdleTimeout:     Duration{time.Minute},
+			DrainPeriod:     Duration{5 * time.Second},
+			ShutdownTimeout: Duration{20 * time.Second}},
+		Database: DatabaseConfig{
+			Address:          "localhost",
+			DialTimeout:      Duration{10 * time.Second},
+			DialRetries:      5,
+			OperationRetries: 2,
+			RetryBackoff:     Duration{500 * time.Millisecond}},
+		Jwt: JwtConfig{
+			Realm:            "jwt auth",
+			SigningAlgorithm: "HS256",
+			Timeout:          Duration{time.Hour},
+			Leeway:           Duration{30 * time.Second},
+			RefreshTimeout:   Duration{30 * 24 * time.Hour},
+			KeyGracePeriod:   Duration{time.Hour}},
+		Swagger: SwaggerConfig{
+			WebServicesUrl:  "/",
+			ApiPath:         "/apidocs.json",
+			SwaggerPath:     "/apidocs/",
+			SwaggerFilePath: "./swagger-ui2/dist"},
+		Cors: CorsConfig{
+			AllowedMethods: []string{"POST", "GET", "PUT", "DELETE"},
+			AllowedHeaders: []string{"Content-Type", "Accept", "Authorization", "X-Requested-With"},
+			MaxAge:         28800},
+		Mail: MailConfig{
+			QueueUrl: "http://localhost:8081",
+			From:     "no-reply@localhost",
+			BaseUrl:  "http://localhost:8080"},
+		Log: LogConfig{Level: "info", Format: "json"},
+		Login: LoginConfig{
+			FreeAttempts:     5,
+			BaseDelay:        Duration{time.Second},
+			MaxDelay:         Duration{15 * time.Minute},
+			LockoutThreshold: 10,
+			LockoutDuration:  Duration{15 * time.Minute},
+			Window:           Duration{time.Hour},
+			AuditRetention:   Duration{90 * 24 * time.Hour}},
+		RateLimit: RateLimitConfig{
+			Requests:     600,
+			AuthRequests: 60,
+			Period:       Duration{time.Minute},
+			Store:        "memory"},
+		Account: AccountConfig{
+			VerificationTimeout: Duration{48 * time.Hour},
+			ResetUrl:            "http://localhost:8080/reset-password",
+			ResetTimeout:        Duration{time.Hour}},
+	}
+}
+
+// Load builds the configuration from the defaults, the config file, the
+// environment and the given command-line arguments, then validates it.
+func Load(args []string) (*Config, error) {
+	cfg := Default()
+
+	fs := flag.NewFlagSet("api", flag.ContinueOnError)
+	configFile := fs.String("config", os.Getenv("CONFIG_FILE"), "path to a .yaml or .json config file")
+	flags := bindFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if *configFile != "" {
+		if err := cfg.loadFile(*configFile); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := cfg.loadEnv(); err != nil {
+		return nil, err
+	}
+
+	// only flags given explicitly override the file and the environment
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		if apply, ok := flags[f.Name]; ok && err == nil {
+			err = apply(cfg, f.Value.String())
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+type setter func(cfg *Config, value string) error
+
+// settings maps flag names to their environment variable and setter.
+var settings = []struct {
+	flag, env, usage string
+	set              setter
+}{
+	{"listen", "API_LISTEN", "address the HTTP server listens on",
+		func(cfg *Config, v string) error { cfg.Server.Listen = v; return nil }},
+	{"cursor-key", "API_CURSOR_KEY", "secret key used to sign pagination cursors",
+		func(cfg *Config, v string) error { cfg.Server.CursorKey = v; return nil }},
+	{"read-timeout", "API_READ_TIMEOUT", "maximum duration for reading a request, e.g. 15s",
+		func(cfg *Config, v string) error { return cfg.Server.ReadTimeout.Set(v) }},
+	{"write-timeout", "API_WRITE_TIMEOUT", "maximum duration for writing a response, e.g. 30s",
+		func(cfg *Config, v string) error { return cfg.Server.WriteTimeout.Set(v) }},
+	{"idle-timeout", "API_IDLE_TIMEOUT", "how long idle keep-alive connections are kept, e.g. 1m",
+		func(cfg *Config, v string) error { return cfg.Server.IdleTimeout.Set(v) }},
+	{"drain-period", "API_DRAIN_PERIOD", "how long readiness fails before shutting down, e.g. 5s",
+		func(cfg *Config, v string) error { return cfg.Server.DrainPeriod.Set(v) }},
+	{"shutdown-timeout", "API_SHUTDOWN_TIMEOUT", "how long in-flight requests get to complete on shutdown, e.g. 20s",
+		func(cfg *Config, v string) error { return cfg.Server.ShutdownTimeout.Set(v) }},
+	{"mongodb-address", "MONGODB_ADDRESS", "MongoDB address",
+		func(cfg *Config, v string) error { cfg.Database.Address = v; return nil }},
+	{"mongodb-database", "MONGODB_DATABASE", "MongoDB database name",
+		func(cfg *Config, v string) error { cfg.Database.Name = v; return nil }},
+	{"mongodb-dial-retries", "MONGODB_DIAL_RETRIES", "how many times to retry connecting to MongoDB",
+		func(cfg *Config, v string) (err error) { cfg.Database.DialRetries, err = strconv.Atoi(v); return err }},
+	{"jwt-realm", "JWT_REALM", "realm reported in WWW-Authenticate",
+		func(cfg *Config, v string) error { cfg.Jwt.Realm = v; return nil }},
+	{"jwt-signing-algorithm", "JWT_SIGNING_ALGORITHM", "JWT signing algorithm (HS256, HS384, HS512)",
+		func(cfg *Config, v string) error { cfg.Jwt.SigningAlgorithm = v; return nil }},
+	{"jwt-key", "JWT_KEY", "secret key used to sign tokens",
+		func(cfg *Config, v string) error { cfg.Jwt.Key = v; return nil }},
+	{"jwt-timeout", "JWT_TIMEOUT", "lifetime of a token, e.g. 1h",
+		func(cfg *Config, v string) error { return cfg.Jwt.Timeout.Set(v) }},
+	{"jwt-issuer", "JWT_ISSUER", "iss of the tokens",
+		func(cfg *Config, v string) error { cfg.Jwt.Issuer = v; return nil }},
+	{"jwt-audience", "JWT_AUDIENCE", "comma separated aud of the tokens",
+		func(cfg *Config, v string) error { cfg.Jwt.Audience = splitList(v); return nil }},
+	{"jwt-leeway", "JWT_LEEWAY", "clock skew tolerated on token dates, e.g. 30s",
+		func(cfg *Config, v string) error { return cfg.Jwt.Leeway.Set(v) }},
+	{"jwt-max-refresh", "JWT_MAX_REFRESH", "how long GET /api/auth/refresh can refresh a token (deprecated, 0 disables it)",
+		func(cfg *Config, v string) error { return cfg.Jwt.MaxRefresh.Set(v) }},
+	{"jwt-key-grace-period", "JWT_KEY_GRACE_PERIOD", "how long a replaced signing key still verifies tokens, e.g. 1h",
+		func(cfg *Config, v string) error { return cfg.Jwt.KeyGracePeriod.Set(v) }},
+	{"jwt-refresh-timeout", "JWT_REFRESH_TIMEOUT", "lifetime of a refresh token, e.g. 720h",
+		func(cfg *Config, v string) error { return cfg.Jwt.RefreshTimeout.Set(v) }},
+	{"cors-allowed-origins", "CORS_ALLOWED_ORIGINS", "comma separated list of allowed CORS origins",
+		func(cfg *Config, v string) error { cfg.Cors.AllowedOrigins = splitList(v); return nil }},
+	{"swagger-file-path", "SWAGGER_FILE_PATH", "directory of the Swagger UI assets",
+		func(cfg *Config, v string) error { cfg.Swagger.SwaggerFilePath = v; return nil }},
+	{"mail-queue-url", "MAIL_QUEUE_URL", "URL of the mail queue",
+		func(cfg *Config, v string) error { cfg.Mail.QueueUrl = v; return nil }},
+	{"mail-from", "MAIL_FROM", "sender of the mails to the users",
+		func(cfg *Config, v string) error { cfg.Mail.From = v; return nil }},
+	{"mail-base-url", "MAIL_BASE_URL", "public URL of the API, for the links in the mails",
+		func(cfg *Config, v string) error { cfg.Mail.BaseUrl = v; return nil }},
+	{"require-verified-email", "REQUIRE_VERIFIED_EMAIL", "refuse logins until the email address is verified",
+		func(cfg *Config, v string) (err error) {
+			cfg.Account.RequireVerifiedEmail, err = strconv.ParseBool(v)
+			return err
+		}},
+	{"verification-timeout", "VERIFICATION_TIMEOUT", "how long email verification links are valid, e.g. 48h",
+		func(cfg *Config, v string) error { return cfg.Account.VerificationTimeout.Set(v) }},
+	{"reset-url", "RESET_URL", "page of the client where users choose a new password",
+		func(cfg *Config, v string) error { cfg.Account.ResetUrl = v; return nil }},
+	{"reset-timeout", "RESET_TIMEOUT", "how long password reset links are valid, e.g. 1h",
+		func(cfg *Config, v string) error { return cfg.Account.ResetTimeout.Set(v) }},
+	{"login-free-attempts", "LOGIN_FREE_ATTEMPTS", "failed logins before the backoff starts",
+		func(cfg *Config, v string) (err error) { cfg.Login.FreeAttempts, err = strconv.Atoi(v); return err }},
+	{"login-lockout-threshold", "LOGIN_LOCKOUT_THRESHOLD", "failed logins locking an account, 0 never locks",
+		func(cfg *Config, v string) (err error) { cfg.Login.LockoutThreshold, err = strconv.Atoi(v); return err }},
+	{"login-lockout-duration", "LOGIN_LOCKOUT_DURATION", "how long an account stays locked, e.g. 15m",
+		func(cfg *Config, v string) error { return cfg.Login.LockoutDuration.Set(v) }},
+	{"rate-limit-requests", "RATE_LIMIT_REQUESTS", "requests per period of a user and of a client IP, 0 disables the limit",
+		func(cfg *Config, v string) (err error) { cfg.RateLimit.Requests, err = strconv.Atoi(v); return err }},
+	{"rate-limit-auth-requests", "RATE_LIMIT_AUTH_REQUESTS", "requests per period of a client IP on the auth routes, 0 disables the limit",
+		func(cfg *Config, v string) (err error) { cfg.RateLimit.AuthRequests, err = strconv.Atoi(v); return err }},
+	{"rate-limit-period", "RATE_LIMIT_PERIOD", "period of the rate limits, e.g. 1m",
+		func(cfg *Config, v string) error { return cfg.RateLimit.Period.Set(v) }},
+	{"rate-limit-store", "RATE_LIMIT_STORE", "where rate limits are counted: memory or mongo",
+		func(cfg *Config, v string) error { cfg.RateLimit.Store = v; return nil }},
+	{"log-level", "LOG_LEVEL", "minimum level logged: debug, info, warn or error",
+		func(cfg *Config, v string) error { cfg.Log.Level = v; return nil }},
+	{"log-format", "LOG_FORMAT", "log output format: json or logfmt",
+		func(cfg *Config, v string) error { cfg.Log.Format = v; return nil }},
+}
+
+func bindFlags(fs *flag.FlagSet) map[string]setter {
+	flags := map[string]setter{}
+	for _, s := range settings {
+		fs.String(s.flag, "", s.usage+" (env "+s.env+")")
+		flags[s.flag] = s.set
+	}
+	return flags
+}
+
+func (cfg *Config) loadFile(path string) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		err = json.Unmarshal(content, cfg)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(content, cfg)
+	default:
+		return fmt.Errorf("config: unsupported file type %s", path)
+	}
+	if err != nil {
+		return fmt.Errorf("config: %s: %v", path, err)
+	}
+	return nil
+}
+
+func (cfg *Config) loadEnv() error {
+	for _, s := range settings {
+		if value := os.Getenv(s.env); value != "" {
+			if err := s.set(cfg, value); err != nil {
+				return fmt.Errorf("config: %s: %v", s.env, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (cfg *Config) Validate() error {
+	errs := []string{}
+
+	if _, _, err := net.SplitHostPort(cfg.Server.Listen); err != nil {
+		errs = append(errs, "server.listen: "+err.Error())
+	}
+	if cfg.Server.ReadTimeout.Duration < 0 || cfg.Server.WriteTimeout.Duration < 0 ||
+		cfg.Server.IdleTimeout.Duration < 0 || cfg.Server.DrainPeriod.Duration < 0 {
+		errs = append(errs, "server timeouts must not be negative")
+	}
+	if cfg.Server.ShutdownTimeout.Duration <= 0 {
+		errs = append(errs, "server.shutdown_timeout must be positive")
+	}
+	if cfg.Database.Address == "" {
+		errs = append(errs, "database.address is required")
+	}
+	if cfg.Database.Name == "" {
+		errs = append(errs, "database.name is required")
+	}
+	if cfg.Database.DialRetries < 0 || cfg.Database.OperationRetries < 0 {
+		errs = append(errs, "database retries must not be negative")
+	}
+	if cfg.Jwt.Realm == "" {
+		errs = append(errs, "jwt.realm is required")
+	}
+	switch cfg.Jwt.SigningAlgorithm {
+	case "HS256", "HS384", "HS512":
+	default:
+		errs = append(errs, "jwt.signing_algorithm must be one of HS256, HS384, HS512")
+	}
+	if cfg.Jwt.Key == "" && len(cfg.Jwt.Keys) == 0 {
+		errs = append(errs, "jwt.key or jwt.keys is required")
+	}
+	if knownKeys[cfg.Jwt.Key] {
+		errs = append(errs, "jwt.key is a published example, anyone could sign tokens with it")
+	}
+	ids := map[string]bool{}
+	for i, key := range cfg.Jwt.Keys {
+		name := "jwt.keys[" + strconv.Itoa(i) + "]"
+		if key.Id == "" || ids[key.Id] {
+			errs = append(errs, name+".id must be set and unique")
+		}
+		ids[key.Id] = true
+		switch key.Algorithm {
+		case "RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA":
+		default:
+			errs = append(errs, name+".algorithm must be one of RS256, RS384, RS512, PS256, PS384, PS512, ES256, ES384, ES512, EdDSA")
+		}
+		if key.File == "" {
+			errs = append(errs, name+".file is required")
+		}
+	}
+	if len(cfg.Jwt.Keys) > 0 && cfg.Jwt.KeyGracePeriod.Duration < cfg.Jwt.Timeout.Duration {
+		errs = append(errs, "jwt.key_grace_period must be at least jwt.timeout")
+	}
+	if cfg.Jwt.Timeout.Duration <= 0 {
+		errs = append(errs, "jwt.timeout must be positive")
+	}
+	if cfg.Jwt.Leeway.Duration < 0 {
+		errs = append(errs, "jwt.leeway must not be negative")
+	}
+	if cfg.Jwt.MaxRefresh.Duration < 0 {
+		errs = append(errs, "jwt.max_refresh must not be negative")
+	}
+	if cfg.Jwt.RefreshTimeout.Duration <= 0 {
+		errs = append(errs, "jwt.refresh_timeout must be positive")
+	}
+	if u, err := url.Parse(cfg.Mail.QueueUrl); err != nil || u.Scheme == "" || u.Host == "" {
+		errs = append(errs, "mail.queue_url must be an absolute URL")
+	}
+	if u, err := url.Parse(cfg.Mail.BaseUrl); err != nil || u.Scheme == "" || u.Host == "" {
+		errs = append(errs, "mail.base_url must be an absolute URL")
+	}
+	if cfg.Mail.From == "" {
+		errs = append(errs, "mail.from is required")
+	}
+	if cfg.Login.FreeAttempts < 0 || cfg.Login.LockoutThreshold < 0 {
+		errs = append(errs, "login attempts must not be negative")
+	}
+	if cfg.Login.BaseDelay.Duration <= 0 || cfg.Login.MaxDelay.Duration < cfg.Login.BaseDelay.Duration {
+		errs = append(errs, "login.base_delay must be positive and at most login.max_delay")
+	}
+	if cfg.Login.LockoutThreshold > 0 && cfg.Login.LockoutDuration.Duration <= 0 {
+		errs = append(errs, "login.lockout_duration must be positive")
+	}
+	if cfg.Login.Window.Duration <= 0 || cfg.Login.AuditRetention.Duration <= 0 {
+		errs = append(errs, "login.window and login.audit_retention must be positive")
+	}
+	if cfg.RateLimit.Requests < 0 || cfg.RateLimit.AuthRequests < 0 {
+		errs = append(errs, "rate_limit requests must not be negative")
+	}
+	if cfg.RateLimit.Period.Duration <= 0 {
+		errs = append(errs, "rate_limit.period must be positive")
+	}
+	switch cfg.RateLimit.Store {
+	case "memory", "mongo":
+	default:
+		errs = append(errs, "rate_limit.store must be memory or mongo")
+	}
+	if cfg.Account.VerificationTimeout.Duration <= 0 || cfg.Account.ResetTimeout.Duration <= 0 {
+		errs = append(errs, "account.verification_timeout and account.reset_timeout must be positive")
+	}
+	if u, err := url.Parse(cfg.Account.ResetUrl); err != nil || u.Scheme == "" || u.Host == "" {
+		errs = append(errs, "account.reset_url must be an absolute URL")
+	}
+
+	switch cfg.Log.Level {
+	case "debug", "info", "warn", "error":
+	default:
+		errs = append(errs, "log.level must be one of debug, info, warn, error")
+	}
+	switch cfg.Log.Format {
+	case "json", "logfmt":
+	default:
+		errs = append(errs, "log.format must be json or logfmt")
+	}
+
+	if len(errs) > 0 {
+		return errors.New("config: " + strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// knownKeys are the example keys of the former defaults and of the docs.
+var knownKeys = map[string]bool{"secret key": true, "change me": true}
+
+func splitList(value string) []string {
+	list := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
@@ -0,0 +1,85 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadPrecedence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "api.yaml")
+	content := "server:\n  listen: \":9000\"\ndatabase:\n  name: fromfile\njwt:\n  key: fromfile\n  timeout: 30m\n"
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv("JWT_KEY", "fromenv")
+	os.Setenv("MONGODB_DATABASE", "fromenv")
+	defer os.Unsetenv("JWT_KEY")
+	defer os.Unsetenv("MONGODB_DATABASE")
+
+	cfg, err := Load([]string{"-config", path, "-jwt-key", "fromflag"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.Server.Listen != ":9000" {
+		t.Errorf("Expected listen from file, got %s", cfg.Server.Listen)
+	}
+	if cfg.Jwt.Timeout.Duration != 30*time.Minute {
+		t.Errorf("Expected timeout from file, got %s", cfg.Jwt.Timeout)
+	}
+	if cfg.Database.Name != "fromenv" {
+		t.Errorf("Expected database name from env, got %s", cfg.Database.Name)
+	}
+	if cfg.Jwt.Key != "fromflag" {
+		t.Errorf("Expected jwt key from flag, got %s", cfg.Jwt.Key)
+	}
+	if cfg.Mail.QueueUrl != "http://localhost:8081" {
+		t.Errorf("Expected default mail queue url, got %s", cfg.Mail.QueueUrl)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cfg := Default()
+	if err := cfg.Validate(); err == nil {
+		t.Errorf("Expected defaults without a database name and a jwt key to be rejected")
+	}
+	cfg.Database.Name = "api"
+	cfg.Jwt.Key = "secret key"
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "jwt.key") {
+		t.Errorf("Expected the former default jwt key to be rejected, got %v", err)
+	}
+	cfg.Jwt.Key = "0fe1f2d3c4b5a697"
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Expected defaults to be valid, got %v", err)
+	}
+
+	cfg.Jwt.Key = ""
+	cfg.Jwt.Keys = []KeyConfig{{Id: "k1", Algorithm: "ES256", File: "k1.pem"}}
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Expected signing keys to replace the key, got %v", err)
+	}
+	cfg.Jwt.Keys = append(cfg.Jwt.Keys, KeyConfig{Id: "k1", Algorithm: "HS256", File: "k2.pem"})
+	if err := cfg.Validate(); err == nil {
+		t.Errorf("Expected duplicate ids and HMAC keys to be rejected")
+	}
+
+	cfg = Default()
+	cfg.Server.Listen = "8080"
+	cfg.Jwt.SigningAlgorithm = "none"
+	cfg.Jwt.Timeout = Duration{}
+	cfg.RateLimit.Store = "redis"
+	if err := cfg.Validate(); err == nil {
+		t.Errorf("Expected invalid config to be rejected")
+	}
+}
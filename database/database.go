@@ -1,9 +1,13 @@
 package database
 
 import (
-	"os"
+	"strings"
+	"time"
 
 	"gopkg.in/mgo.v2"
+
+	"../config"
+	"../logger"
 )
 
 var (
@@ -13,32 +17,108 @@ var (
 type MyDb struct {
 	session  *mgo.Session
 	database *mgo.Database
+	cfg      config.DatabaseConfig
+	log      *logger.Logger
 }
 
-func NewMyDb() *MyDb {
+func NewMyDb(cfg config.DatabaseConfig, log *logger.Logger) (*MyDb, error) {
 	myDb := new(MyDb)
+	myDb.cfg = cfg
+	myDb.log = log.WithField("component", "database")
 
 	var err error
-	myDb.session, err = mgo.Dial(os.Getenv("MONGODB_ADDRESS"))
+	myDb.session, err = myDb.dial()
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	// Optional. Switch the session to a monotonic behavior.
 	myDb.session.SetMode(mgo.Monotonic, true)
-	myDb.database = myDb.session.DB(os.Getenv("MONGODB_DATABASE"))
+	myDb.database = myDb.session.DB(cfg.Name)
+
+	return myDb, nil
+}
 
-	return myDb
+// dial retries mgo.Dial with an exponential backoff so the API can start
+// while Mongo is still coming up.
+func (myDb *MyDb) dial() (*mgo.Session, error) {
+	cfg := myDb.cfg
+	backoff := cfg.RetryBackoff.Duration
+	for attempt := 0; ; attempt++ {
+		session, err := mgo.DialWithTimeout(cfg.Address, cfg.DialTimeout.Duration)
+		if err == nil {
+			myDb.log.WithField("address", cfg.Address).Info("connected to mongo")
+		}
+		if err == nil || attempt >= cfg.DialRetries {
+			return session, err
+		}
+		myDb.log.With(logger.Fields{"address": cfg.Address, "error": err, "retry_in": backoff.String()}).
+			Warn("can't reach mongo, retrying")
+		time.Sleep(backoff)
+		backoff *= 2
+	}
 }
 
 func (myDb *MyDb) Destroy() {
 	myDb.session.Close()
 }
 
+// CopySession returns a new session sharing the cluster of the main one but
+// using its own socket. Callers must Close it when done.
+func (myDb *MyDb) CopySession() *mgo.Session {
+	return myDb.session.Copy()
+}
+
+// SessionDatabase returns the configured database bound to the given session.
+func (myDb *MyDb) SessionDatabase(session *mgo.Session) *mgo.Database {
+	return session.DB(myDb.cfg.Name)
+}
+
+func (myDb *MyDb) GetDatabase() *mgo.Database {
+	return myDb.database
+}
+
+// Ping checks Mongo can be reached, on a copy of the session so a broken
+// socket is not kept.
+func (myDb *MyDb) Ping() error {
+	session := myDb.session.Copy()
+	defer session.Close()
+	return session.Ping()
+}
+
+func (myDb *MyDb) EnsureUniqueIndex(collectionName string, key ...string) error {
+	return myDb.GetCollection(collectionName).EnsureIndex(mgo.Index{Key: key, Unique: true})
+}
+
+// EnsureSparseUniqueIndex is EnsureUniqueIndex for optional fields: the
+// documents without them are left out of the index.
+func (myDb *MyDb) EnsureSparseUniqueIndex(collectionName string, key ...string) error {
+	return myDb.GetCollection(collectionName).EnsureIndex(mgo.Index{Key: key, Unique: true, Sparse: true})
+}
+
+// HasIndex tells whether the collection has an index on exactly key.
+func (myDb *MyDb) HasIndex(collectionName string, key ...string) (bool, error) {
+	session := myDb.session.Copy()
+	defer session.Close()
+
+	indexes, err := myDb.SessionDatabase(session).C(collectionName).Indexes()
+	if err != nil {
+		return false, err
+	}
+	for _, index := range indexes {
+		if strings.Join(index.Key, ",") == strings.Join(key, ",") {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
 func (myDb *MyDb) GetCollection(collectionName string) *mgo.Collection {
 	return myDb.database.C(collectionName)
 }
 
-func Init() {
-	GMyDb = NewMyDb()
+func Init(cfg config.DatabaseConfig, log *logger.Logger) error {
+	var err error
+	GMyDb, err = NewMyDb(cfg, log)
+	return err
 }
@@ -1,22 +1,40 @@
 package gjwt
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
-	"fmt"
 	"log"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
 	"gopkg.in/mgo.v2/bson"
 
-	"github.com/ant0ine/go-json-rest/rest"
 	"github.com/dgrijalva/jwt-go"
 	"github.com/emicklei/go-restful"
+
+	"../apierror"
+	"../logger"
+	"../metrics"
 )
 
 var (
-	Env map[string]interface{}
+	ErrMissingToken       = apierror.ErrUnauthorized.WithCode("missing_token").WithMessage("Authorization header is missing")
+	ErrInvalidToken       = apierror.ErrUnauthorized.WithCode("invalid_token").WithMessage("Invalid token")
+	ErrTokenExpired       = apierror.ErrUnauthorized.WithCode("token_expired").WithMessage("Token has expired")
+	ErrTokenNotYetValid   = apierror.ErrUnauthorized.WithCode("token_not_yet_valid").WithMessage("Token is not valid yet")
+	ErrInvalidIssuer      = apierror.ErrUnauthorized.WithCode("invalid_issuer").WithMessage("Token was issued by another issuer")
+	ErrInvalidAudience    = apierror.ErrUnauthorized.WithCode("invalid_audience").WithMessage("Token is not intended for this audience")
+	ErrRefreshExpired     = apierror.ErrUnauthorized.WithCode("refresh_expired").WithMessage("Token can no longer be refreshed")
+	ErrInvalidCredentials = apierror.ErrUnauthorized.WithCode("invalid_credentials").WithMessage("Wrong username or password")
+	ErrTokenRevoked       = apierror.ErrUnauthorized.WithCode("token_revoked").WithMessage("Token has been revoked")
+	ErrInvalidRefresh     = apierror.ErrUnauthorized.WithCode("invalid_refresh_token").WithMessage("Invalid refresh token")
+	ErrRefreshReused      = apierror.ErrUnauthorized.WithCode("refresh_token_reused").WithMessage("Refresh token was already used")
+	ErrEmailNotVerified   = apierror.ErrForbidden.WithCode("email_not_verified").WithMessage("Email address is not verified yet")
+
+	errRefreshUnsupported = apierror.New(http.StatusNotImplemented, "refresh_unsupported", "Refresh tokens are not enabled")
 )
 
 type JwtService struct {
@@ -28,21 +46,62 @@ type JwtService struct {
 	// Optional, default is HS256.
 	SigningAlgorithm string
 
-	// Secret key used for signing. Required.
+	// Secret key used for signing. Required without Keys.
 	Key []byte
 
+	// Keys signing and verifying tokens, by their kid header. Set it to sign
+	// with RSA, ECDSA or Ed25519 keys and rotate them.
+	// Optional, by default tokens are signed with Key and SigningAlgorithm.
+	Keys *KeySet
+
 	// Duration that a jwt token is valid. Optional, defaults to one hour.
 	Timeout time.Duration
 
+	// The iss of the tokens issued, required in the tokens verified.
+	// Optional, by default tokens have no issuer.
+	Issuer string
+
+	// The aud of the tokens issued; the tokens verified must be intended for
+	// one of them. Optional, by default tokens have no audience.
+	Audience []string
+
+	// Clock skew tolerated when checking exp, nbf and iat.
+	// Optional, defaults to 0.
+	Leeway time.Duration
+
 	// This field allows clients to refresh their token until MaxRefresh has passed.
 	// Note that clients can refresh their token in the last moment of MaxRefresh.
 	// This means that the maximum validity timespan for a token is MaxRefresh + Timeout.
 	// Optional, defaults to 0 meaning not refreshable.
+	// Deprecated: a leaked token can be refreshed until MaxRefresh has passed;
+	// use RefreshTokens instead.
 	MaxRefresh time.Duration
 
+	// Stores the opaque refresh tokens issued along with access tokens. Each
+	// refresh token can be exchanged once by TokenHandler; reusing one revokes
+	// every token descending from the same login.
+	// Optional, by default no refresh token is issued.
+	RefreshTokens RefreshStore
+
+	// Duration that a refresh token is valid; every exchange issues a new one.
+	// Optional, defaults to 30 days.
+	RefreshTimeout time.Duration
+
+	// Callback function that loads the current user document of a refresh
+	// token, so that new access tokens get the current claims. Must return
+	// false for unknown or deleted users. Required with RefreshTokens.
+	UserFunc func(userId string, request *restful.Request) (bson.M, bool)
+
 	// Callback function that should perform the authentication of the user based on userId and
-	// password. Must return true on success, false on failure. Required.
-	Authenticator func(userId string, password string) (bson.M, bool)
+	// password. The request is passed along so the callback can use request-scoped resources.
+	// Must return true on success, false on failure. Required.
+	Authenticator func(userId string, password string, request *restful.Request) (bson.M, bool)
+
+	// Callback function that tells whether an authenticated user may log in,
+	// like once their email address is verified. Logins it refuses get
+	// ErrEmailNotVerified.
+	// Optional, by default every authenticated user may log in.
+	VerifiedFunc func(usr bson.M) bool
 
 	// Callback function that should perform the authorization of the authenticated user. Called
 	// only after an authentication success. Must return true on success, false on failure.
@@ -51,11 +110,34 @@ type JwtService struct {
 
 	// Callback function that will be called during login.
 	// Using this function it is possible to add additional payload data to the webtoken.
-	// The data is then made available during requests via request.Env["JWT_PAYLOAD"].
+	// The data is then made available during requests via Principal.Claims.
 	// Note that the payload is not encrypted.
 	// The attributes mentioned on jwt.io can't be used as keys for the map.
 	// Optional, by default no additional data will be set.
 	PayloadFunc func(userId string) map[string]interface{}
+
+	// Callback function that returns claims derived from the stored user document, such as
+	// its roles and permissions. Called on login and signup.
+	// Optional, by default no additional claims will be set.
+	UserClaimsFunc func(usr bson.M) map[string]interface{}
+
+	// Writes the *apierror.Error of a failed request, so that they look like the
+	// errors of the rest of the API.
+	// Optional, by default the message is written as plain text.
+	ErrorWriter func(response *restful.Response, err *apierror.Error)
+
+	// Logger for authentication events. Credentials are never logged.
+	// Optional, by default nothing is logged.
+	Logger *logger.Logger
+
+	// Throttles the failed logins per account and per client IP.
+	// Optional, by default attempts are not limited.
+	Throttle *LoginThrottle
+
+	// Remembers the tokens revoked by logout and the users whose tokens were
+	// all revoked, like after a password change.
+	// Optional, by default tokens stay valid until they expire.
+	Revocations RevocationStore
 }
 
 type AuthUser struct {
@@ -64,91 +146,279 @@ type AuthUser struct {
 
 // Handler that clients can use to get a jwt token.
 // Payload needs to be json in the form of {"username": "USERNAME", "password": "PASSWORD"}.
-// Reply will be of the form {"token": "TOKEN"}.
+// Reply will be of the form {"meta": {"token": "TOKEN", "refresh_token": "REFRESH_TOKEN"}},
+// with a refresh token when RefreshTokens is set.
 func (jwts *JwtService) LoginHandler(request *restful.Request, response *restful.Response) {
-	fmt.Println("Logging In")
-
 	data := bson.M{}
 	if err := request.ReadEntity(&data); err != nil {
-		fmt.Println("Empty Username or Password")
-		fmt.Println(err)
+		jwts.writeError(response, apierror.ErrBadRequest.WithCode("invalid_body").WithCause(err))
+		return
+	}
+
+	username, _ := data["username"].(string)
+	password, _ := data["password"].(string)
+	if username == "" || password == "" {
+		metrics.Logins.WithLabelValues(metrics.ResultFailure).Inc()
+		jwts.writeError(response, ErrInvalidCredentials)
+		return
+	}
 
-		jwts.unauthorized(response)
+	if jwts.throttled(request, response, username) {
 		return
 	}
 
-	fmt.Println("From user inputs:", data)
-	usr, ok := jwts.Authenticator(data["username"].(string), data["password"].(string))
+	usr, ok := jwts.Authenticator(username, password, request)
 	if !ok {
-		fmt.Println("Wrong Username or Password")
-		jwts.unauthorized(response)
+		metrics.Logins.WithLabelValues(metrics.ResultFailure).Inc()
+		jwts.loginFailed(request, username, ReasonInvalidCredentials)
+		jwts.writeError(response, ErrInvalidCredentials)
+		return
+	}
+	if jwts.Throttle != nil {
+		if err := jwts.Throttle.For(request).Succeeded(username); err != nil {
+			jwts.Logger.WithField("error", err).Error("can't reset the failed logins")
+		}
+	}
+	// checked after the password, not to tell which accounts exist
+	if jwts.VerifiedFunc != nil && !jwts.VerifiedFunc(usr) {
+		metrics.Logins.WithLabelValues(metrics.ResultFailure).Inc()
+		jwts.writeError(response, ErrEmailNotVerified)
 		return
 	}
 
-	token := jwt.New(jwt.GetSigningMethod(jwts.SigningAlgorithm))
+	tokens, err := jwts.userTokens(usr, "")
+	if err != nil {
+		jwts.writeError(response, err)
+		return
+	}
 
-	if jwts.PayloadFunc != nil {
-		for key, value := range jwts.PayloadFunc(data["username"].(string)) {
-			token.Claims[key] = value
-		}
+	metrics.Logins.WithLabelValues(metrics.ResultSuccess).Inc()
+	response.WriteEntity(&bson.M{"meta": tokens})
+}
+
+// SignupTokens returns the tokens of a user who just signed up, as if they
+// had logged in.
+func (jwts *JwtService) SignupTokens(usr bson.M) (bson.M, error) {
+	return jwts.userTokens(usr, "")
+}
+
+// TokenHandler exchanges a refresh token for new access and refresh tokens.
+// Payload needs to be json in the form of {"refresh_token": "REFRESH_TOKEN"}.
+// Reply is like the one of LoginHandler.
+func (jwts *JwtService) TokenHandler(request *restful.Request, response *restful.Response) {
+	if jwts.RefreshTokens == nil {
+		jwts.writeError(response, errRefreshUnsupported)
+		return
 	}
 
-	fmt.Printf("The user from logindb %v", usr)
-	token.Claims["id"] = usr["_id"].(bson.ObjectId)
-	token.Claims["username"] = usr["username"].(string)
-	token.Claims["exp"] = time.Now().Add(jwts.Timeout).Unix()
-	if jwts.MaxRefresh != 0 {
-		token.Claims["orig_iat"] = time.Now().Unix()
+	data := bson.M{}
+	if err := request.ReadEntity(&data); err != nil {
+		jwts.writeError(response, apierror.ErrBadRequest.WithCode("invalid_body").WithCause(err))
+		return
 	}
-	tokenString, err := token.SignedString(jwts.Key)
+	refresh, _ := data["refresh_token"].(string)
 
+	tokens, err := jwts.rotate(refresh, request)
 	if err != nil {
-		response.WriteErrorString(http.StatusUnauthorized, "Unauthorized Access")
-		jwts.unauthorized(response)
+		result := metrics.ResultFailure
+		if err == ErrRefreshReused {
+			result = metrics.ResultReused
+		}
+		metrics.TokenRefreshes.WithLabelValues(result).Inc()
+		jwts.writeError(response, err)
 		return
 	}
 
-	response.WriteEntity(&bson.M{"meta": bson.M{"token": tokenString}})
+	metrics.TokenRefreshes.WithLabelValues(metrics.ResultSuccess).Inc()
+	response.WriteEntity(&bson.M{"meta": tokens})
 }
 
-// Handler that clients can use to get a jwt token.
-// Payload needs to be json in the form of {"username": "USERNAME", "password": "PASSWORD"}.
-// Reply will be of the form {"token": "TOKEN"}.
-func (jwts *JwtService) SignupToken(request *restful.Request, response *restful.Response, usr bson.M) string {
-	fmt.Println("Getting signup token")
+// rotate uses up the refresh token and issues new tokens in its family. A
+// token used twice was leaked, or stolen from a legitimate client: every
+// token of the user is revoked, including the access tokens already issued,
+// logging out both.
+func (jwts *JwtService) rotate(refresh string, request *restful.Request) (bson.M, error) {
+	if refresh == "" {
+		return nil, ErrInvalidRefresh
+	}
+	stored, err := jwts.RefreshTokens.Use(hashRefreshToken(refresh))
+	if err != nil {
+		return nil, apierror.ErrInternal.WithCause(err)
+	}
+	if stored == nil || stored.ExpiresAt.Before(time.Now()) {
+		return nil, ErrInvalidRefresh
+	}
+	if stored.Used {
+		jwts.Logger.With(logger.Fields{"user_id": stored.UserId, "family": stored.Family}).
+			Warn("refresh token reused, revoking every token of the user")
+		if err := jwts.RevokeUser(stored.UserId); err != nil {
+			return nil, apierror.ErrInternal.WithCause(err)
+		}
+		return nil, ErrRefreshReused
+	}
 
-	data := &AuthUser{}
-	if err := request.ReadEntity(data); err != nil {
-		fmt.Println("Empty Username or Password")
-		fmt.Println(err)
+	usr, ok := jwts.UserFunc(stored.UserId, request)
+	if !ok {
+		return nil, ErrInvalidRefresh
+	}
+	return jwts.userTokens(usr, stored.Family)
+}
 
-		jwts.unauthorized(response)
-		return ""
+// throttled refuses the login with 429 and Retry-After when the account or
+// the client IP has to wait after failed logins.
+func (jwts *JwtService) throttled(request *restful.Request, response *restful.Response, username string) bool {
+	if jwts.Throttle == nil {
+		return false
+	}
+	wait, err := jwts.Throttle.For(request).Check(username, ClientIP(request.Request), time.Now())
+	if err == nil {
+		return false
 	}
+	if wait > 0 {
+		metrics.Logins.WithLabelValues(metrics.ResultThrottled).Inc()
+		reason := ReasonThrottled
+		if err == ErrAccountLocked {
+			reason = ReasonLocked
+		}
+		jwts.loginFailed(request, username, reason)
+		response.AddHeader("Retry-After", strconv.Itoa(int((wait+time.Second-1)/time.Second)))
+	}
+	jwts.writeError(response, err)
+	return true
+}
 
-	token := jwt.New(jwt.GetSigningMethod(jwts.SigningAlgorithm))
+// loginFailed logs and audits a failed login, counting it when the
+// credentials were checked.
+func (jwts *JwtService) loginFailed(request *restful.Request, username, reason string) {
+	attempt := &FailedLogin{
+		Username:  username,
+		IP:        ClientIP(request.Request),
+		UserAgent: request.Request.UserAgent(),
+		Reason:    reason,
+		At:        time.Now()}
+	jwts.Logger.With(logger.Fields{"username": username, "ip": attempt.IP, "reason": reason}).Warn("login failed")
+	if jwts.Throttle == nil {
+		return
+	}
+
+	if reason == ReasonInvalidCredentials {
+		if err := jwts.Throttle.For(request).Failed(username, attempt.IP, attempt.At); err != nil {
+			jwts.Logger.WithField("error", err).Error("can't count the failed login")
+		}
+	}
+	if err := jwts.Throttle.record(attempt); err != nil {
+		jwts.Logger.WithField("error", err).Error("can't audit the failed login")
+	}
+}
+
+// userTokens returns the access token of the user and, when refresh tokens
+// are enabled, a refresh token in family, a new one when empty.
+func (jwts *JwtService) userTokens(usr bson.M, family string) (bson.M, error) {
+	token, err := jwts.userToken(usr)
+	if err != nil {
+		return nil, err
+	}
+	tokens := bson.M{"token": token}
+	if jwts.RefreshTokens == nil {
+		return tokens, nil
+	}
+
+	if family == "" {
+		family = newJti()
+	}
+	refresh, hash := newRefreshToken()
+	err = jwts.RefreshTokens.Save(&RefreshToken{
+		Hash:      hash,
+		UserId:    usr["_id"].(bson.ObjectId).Hex(),
+		Family:    family,
+		ExpiresAt: time.Now().Add(jwts.RefreshTimeout)})
+	if err != nil {
+		return nil, apierror.ErrInternal.WithCause(err)
+	}
+	tokens["refresh_token"] = refresh
+	return tokens, nil
+}
+
+// userToken returns a new token for the stored user document.
+func (jwts *JwtService) userToken(usr bson.M) (string, error) {
+	token := jwts.newToken()
 
 	if jwts.PayloadFunc != nil {
-		for key, value := range jwts.PayloadFunc(data.username) {
-			token.Claims[key] = value
+		username, _ := usr["username"].(string)
+		for key, value := range jwts.PayloadFunc(username) {
+			claimsOf(token)[key] = value
 		}
 	}
 
-	token.Claims["id"] = usr["_id"].(bson.ObjectId)
-	token.Claims["username"] = usr["username"].(string)
-	token.Claims["exp"] = time.Now().Add(jwts.Timeout).Unix()
+	jwts.setUserClaims(token, usr)
+	claimsOf(token)["exp"] = time.Now().Add(jwts.Timeout).Unix()
 	if jwts.MaxRefresh != 0 {
-		token.Claims["orig_iat"] = time.Now().Unix()
+		claimsOf(token)["orig_iat"] = time.Now().Unix()
 	}
-	tokenString, err := token.SignedString(jwts.Key)
+	return jwts.sign(token)
+}
 
+// newToken returns a token with a unique jti, so it can be revoked, and an iat
+// with millisecond precision, to compare with the watermarks of the users.
+// Its signing method is set by sign.
+func (jwts *JwtService) newToken() *jwt.Token {
+	now := time.Now()
+	token := jwt.New(jwt.GetSigningMethod(jwts.SigningAlgorithm))
+	claimsOf(token)["jti"] = newJti()
+	claimsOf(token)["iat"] = numericDate(now)
+	claimsOf(token)["nbf"] = now.Unix()
+	if jwts.Issuer != "" {
+		claimsOf(token)["iss"] = jwts.Issuer
+	}
+	switch len(jwts.Audience) {
+	case 0:
+	case 1:
+		claimsOf(token)["aud"] = jwts.Audience[0]
+	default:
+		claimsOf(token)["aud"] = jwts.Audience
+	}
+	return token
+}
+
+// sign signs the token with the current signing key, naming it in the kid
+// header so verifiers can pick the key.
+func (jwts *JwtService) sign(token *jwt.Token) (string, error) {
+	key, err := jwts.Keys.SigningKey(time.Now())
+	if err != nil {
+		return "", apierror.ErrInternal.WithCause(err)
+	}
+	token.Method = jwt.GetSigningMethod(key.Algorithm)
+	token.Header["alg"] = key.Algorithm
+	if key.Id != "" {
+		token.Header["kid"] = key.Id
+	}
+	tokenString, err := token.SignedString(key.Private)
 	if err != nil {
-		response.WriteErrorString(http.StatusUnauthorized, "Unauthorized Access")
-		jwts.unauthorized(response)
-		return ""
+		return "", apierror.ErrInternal.WithCause(err)
 	}
+	return tokenString, nil
+}
+
+func newJti() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
 
-	return tokenString
+// numericDate is t in seconds since the epoch, truncated to milliseconds.
+func numericDate(t time.Time) float64 {
+	return float64(t.UnixNano()/int64(time.Millisecond)) / 1000
+}
+
+func (jwts *JwtService) setUserClaims(token *jwt.Token, usr bson.M) {
+	if jwts.UserClaimsFunc != nil {
+		for key, value := range jwts.UserClaimsFunc(usr) {
+			claimsOf(token)[key] = value
+		}
+	}
+	claimsOf(token)["id"] = usr["_id"].(bson.ObjectId)
+	claimsOf(token)["sub"] = usr["_id"].(bson.ObjectId).Hex()
+	claimsOf(token)["username"] = usr["username"].(string)
 }
 
 func (jwts *JwtService) IsValidToken(request *restful.Request) bool {
@@ -160,12 +430,17 @@ func (jwts *JwtService) IsValidToken(request *restful.Request) bool {
 		return false
 	}
 
-	origIat := int64(token.Claims["orig_iat"].(float64))
+	return jwts.checkRefresh(token) == nil
+}
 
-	if origIat < time.Now().Add(-jwts.MaxRefresh).Unix() {
-		return false
+// checkRefresh fails once MaxRefresh has passed since the login the token
+// descends from.
+func (jwts *JwtService) checkRefresh(token *jwt.Token) error {
+	origIat, ok := claimsOf(token)["orig_iat"].(float64)
+	if !ok || int64(origIat) < time.Now().Add(-jwts.MaxRefresh).Unix() {
+		return ErrRefreshExpired
 	}
-	return true
+	return nil
 }
 
 func (jwts *JwtService) RefreshHandler(request *restful.Request, response *restful.Response) {
@@ -173,107 +448,266 @@ func (jwts *JwtService) RefreshHandler(request *restful.Request, response *restf
 
 	// Token should be valid anyway as the RefreshHandler is authed
 	if err != nil {
-		jwts.unauthorized(response)
+		metrics.TokenRefreshes.WithLabelValues(metrics.ResultFailure).Inc()
+		jwts.writeError(response, err)
 		return
 	}
 
-	origIat := int64(token.Claims["orig_iat"].(float64))
-
-	if origIat < time.Now().Add(-jwts.MaxRefresh).Unix() {
-		jwts.unauthorized(response)
+	if err := jwts.checkRefresh(token); err != nil {
+		metrics.TokenRefreshes.WithLabelValues(metrics.ResultFailure).Inc()
+		jwts.writeError(response, err)
 		return
 	}
+	origIat := int64(claimsOf(token)["orig_iat"].(float64))
 
-	newToken := jwt.New(jwt.GetSigningMethod(jwts.SigningAlgorithm))
+	newToken := jwts.newToken()
 
-	for key := range token.Claims {
-		newToken.Claims[key] = token.Claims[key]
+	for key := range claimsOf(token) {
+		if key != "jti" && key != "iat" && key != "nbf" {
+			claimsOf(newToken)[key] = claimsOf(token)[key]
+		}
 	}
 
-	newToken.Claims["id"] = token.Claims["id"]
-	newToken.Claims["exp"] = time.Now().Add(jwts.Timeout).Unix()
-	newToken.Claims["orig_iat"] = origIat
-	tokenString, err := newToken.SignedString(jwts.Key)
+	claimsOf(newToken)["id"] = claimsOf(token)["id"]
+	claimsOf(newToken)["exp"] = time.Now().Add(jwts.Timeout).Unix()
+	claimsOf(newToken)["orig_iat"] = origIat
+	tokenString, err := jwts.sign(newToken)
 
 	if err != nil {
-		jwts.unauthorized(response)
+		jwts.writeError(response, err)
 		return
 	}
 
+	metrics.TokenRefreshes.WithLabelValues(metrics.ResultSuccess).Inc()
 	response.WriteEntity(&map[string]string{"token": tokenString})
 }
 
+// parseToken returns the valid token of the request, or an *apierror.Error
+// telling why there is none.
 func (jwts *JwtService) parseToken(request *restful.Request) (*jwt.Token, error) {
 	authHeader := request.HeaderParameter("Authorization")
 
 	if authHeader == "" {
-		return nil, errors.New("Auth header empty")
+		return nil, ErrMissingToken
 	}
 
 	parts := strings.SplitN(authHeader, " ", 2)
 	if !(len(parts) == 2 && parts[0] == "Bearer") {
-		return nil, errors.New("Invalid auth header")
+		return nil, ErrInvalidToken.WithMessage("Authorization header must be Bearer TOKEN")
 	}
 
-	return jwt.Parse(parts[1], func(token *jwt.Token) (interface{}, error) {
-		if jwt.GetSigningMethod(jwts.SigningAlgorithm) != token.Method {
+	// the dates are checked by validateClaims, with leeway
+	parser := jwt.Parser{SkipClaimsValidation: true}
+	token, err := parser.Parse(parts[1], func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		key, ok := jwts.Keys.VerifyingKey(kid, time.Now())
+		if !ok {
+			return nil, errors.New("Unknown or retired signing key")
+		}
+		if key.Algorithm != token.Method.Alg() {
 			return nil, errors.New("Invalid signing algorithm")
 		}
-		return jwts.Key, nil
+		return key.Public, nil
 	})
+	if err != nil {
+		return nil, ErrInvalidToken.WithCause(err)
+	}
+	if err := jwts.validateClaims(token, time.Now()); err != nil {
+		return nil, err
+	}
+	if err := jwts.checkRevoked(token); err != nil {
+		return nil, err
+	}
+	return token, nil
 }
 
-func (jwts *JwtService) unauthorized(response *restful.Response) {
-	response.AddHeader("WWW-Authenticate", "JWT realm="+jwts.Realm)
-	response.WriteErrorString(http.StatusUnauthorized, "Not Authorized")
+// claimsOf returns the claims of a token, jwt.MapClaims for the tokens made
+// by jwt.New and jwt.Parser.Parse.
+func claimsOf(token *jwt.Token) jwt.MapClaims {
+	claims, _ := token.Claims.(jwt.MapClaims)
+	return claims
 }
 
-type HandlerFunc func(request *restful.Request, response *restful.Response)
-
-// Init
-func (jwts *JwtService) Init() {
-
-	if jwts.Realm == "" {
-		log.Fatal("Realm is required")
+// validateClaims checks the registered claims of a token whose signature was
+// verified, tolerating Leeway of clock skew on the dates.
+func (jwts *JwtService) validateClaims(token *jwt.Token, now time.Time) error {
+	exp, ok := claimsOf(token)["exp"].(float64)
+	if !ok {
+		return ErrInvalidToken.WithMessage("Token has no expiration time")
 	}
-	if jwts.SigningAlgorithm == "" {
-		jwts.SigningAlgorithm = "HS256"
+	if now.After(unixTime(exp).Add(jwts.Leeway)) {
+		return ErrTokenExpired
 	}
-	if jwts.Key == nil {
-		log.Fatal("Key required")
+	if nbf, ok := claimsOf(token)["nbf"].(float64); ok && now.Add(jwts.Leeway).Before(unixTime(nbf)) {
+		return ErrTokenNotYetValid
 	}
-	if jwts.Timeout == 0 {
-		jwts.Timeout = time.Hour
+	if iat, ok := claimsOf(token)["iat"].(float64); ok && now.Add(jwts.Leeway).Before(unixTime(iat)) {
+		return ErrTokenNotYetValid.WithMessage("Token was issued in the future")
 	}
-	if jwts.Authenticator == nil {
-		log.Fatal("Authenticator is required")
+	if jwts.Issuer != "" && claimsOf(token)["iss"] != jwts.Issuer {
+		return ErrInvalidIssuer
 	}
-	if jwts.Authorizator == nil {
-		jwts.Authorizator = func(userId string, request *restful.Request) bool {
-			return true
+	if len(jwts.Audience) > 0 && !jwts.intendedFor(claimsOf(token)["aud"]) {
+		return ErrInvalidAudience
+	}
+	if sub, ok := claimsOf(token)["sub"].(string); ok && sub != claimsOf(token)["id"] {
+		return ErrInvalidToken.WithMessage("Token subject does not match its id")
+	}
+	return nil
+}
+
+// intendedFor tells whether aud, a string or a list, names one of Audience.
+func (jwts *JwtService) intendedFor(aud interface{}) bool {
+	var auds []interface{}
+	switch a := aud.(type) {
+	case string:
+		auds = []interface{}{a}
+	case []interface{}:
+		auds = a
+	}
+	for _, a := range auds {
+		for _, audience := range jwts.Audience {
+			if a == audience {
+				return true
+			}
 		}
 	}
+	return false
 }
 
-func (jwts *JwtService) Guard(request *restful.Request, response *restful.Response) (bson.M, error) {
-	token, err := jwts.parseToken(request)
+func unixTime(seconds float64) time.Time {
+	return time.Unix(0, int64(seconds*float64(time.Second)))
+}
 
+// checkRevoked fails for tokens revoked by jti or issued before the watermark
+// of their user. Tokens without jti or iat predate revocation support: they
+// can only be revoked by a watermark.
+func (jwts *JwtService) checkRevoked(token *jwt.Token) error {
+	if jwts.Revocations == nil {
+		return nil
+	}
+	if jti, ok := claimsOf(token)["jti"].(string); ok {
+		revoked, err := jwts.Revocations.IsRevoked(jti)
+		if err != nil {
+			return apierror.ErrInternal.WithCause(err)
+		}
+		if revoked {
+			return ErrTokenRevoked
+		}
+	}
+	userId, _ := claimsOf(token)["id"].(string)
+	watermark, err := jwts.Revocations.RevokedBefore(userId)
 	if err != nil {
-		jwts.unauthorized(response)
-		return nil, err
+		return apierror.ErrInternal.WithCause(err)
+	}
+	if iat, _ := claimsOf(token)["iat"].(float64); !watermark.IsZero() && iat <= numericDate(watermark) {
+		return ErrTokenRevoked
 	}
+	return nil
+}
 
-	origIat := int64(token.Claims["orig_iat"].(float64))
+// RevokeUser invalidates every token issued to the user so far, refresh
+// tokens included.
+func (jwts *JwtService) RevokeUser(userId string) error {
+	if jwts.RefreshTokens != nil {
+		if err := jwts.RefreshTokens.RevokeUser(userId); err != nil {
+			return err
+		}
+	}
+	if jwts.Revocations == nil {
+		return nil
+	}
+	return jwts.Revocations.RevokeBefore(userId, time.Now())
+}
 
-	if origIat < time.Now().Add(-jwts.MaxRefresh).Unix() {
-		return nil, err
+// LogoutHandler revokes the bearer token of the request, along with the
+// refresh token given as {"refresh_token": "REFRESH_TOKEN"}, or with
+// ?all=true every token of its user, to log out of all devices.
+func (jwts *JwtService) LogoutHandler(request *restful.Request, response *restful.Response) {
+	principal, err := jwts.authenticate(request)
+	if err == nil && jwts.Revocations == nil {
+		err = apierror.New(http.StatusNotImplemented, "logout_unsupported", "Tokens cannot be revoked")
+	}
+	if err != nil {
+		jwts.writeError(response, err)
+		return
+	}
+
+	userId := principal.Id
+	if request.QueryParameter("all") == "true" {
+		err = jwts.RevokeUser(userId)
+	} else {
+		jti, _ := principal.Claims["jti"].(string)
+		exp, _ := principal.Claims["exp"].(float64)
+		if jti == "" {
+			// older tokens have no jti, only a watermark can revoke them
+			err = jwts.RevokeUser(userId)
+		} else {
+			// remembered as long as validateClaims accepts the token
+			err = jwts.Revocations.Revoke(jti, unixTime(exp).Add(jwts.Leeway))
+		}
+		if err == nil {
+			err = jwts.revokeRefresh(request, userId)
+		}
+	}
+	if err != nil {
+		jwts.writeError(response, apierror.ErrInternal.WithCause(err))
+		return
+	}
+
+	jwts.Logger.With(logger.Fields{"user_id": userId, "all": request.QueryParameter("all") == "true"}).Info("logout")
+	response.WriteHeader(http.StatusNoContent)
+}
+
+// JWKSHandler publishes the public keys verifying the tokens as a JSON Web
+// Key Set, for other services to verify them without sharing a secret.
+func (jwts *JwtService) JWKSHandler(request *restful.Request, response *restful.Response) {
+	response.AddHeader("Cache-Control", "public, max-age=300")
+	response.WriteEntity(map[string][]JWK{"keys": jwts.Keys.JWKS(time.Now())})
+}
+
+// writeError reports a failed request, challenging the client on 401 as RFC
+// 6750 describes: the reason a token was rejected is in error_description.
+func (jwts *JwtService) writeError(response *restful.Response, err error) {
+	e := apierror.From(err)
+	if e.Status == http.StatusUnauthorized {
+		challenge := `Bearer realm="` + jwts.Realm + `"`
+		if e.Code != ErrMissingToken.Code && e.Code != ErrInvalidCredentials.Code {
+			challenge += `, error="invalid_token", error_description="` + e.Message + `"`
+		}
+		response.AddHeader("WWW-Authenticate", challenge)
+	}
+	if jwts.ErrorWriter != nil {
+		jwts.ErrorWriter(response, e)
+		return
 	}
+	response.WriteErrorString(e.Status, e.Message)
+}
 
-	return bson.M{"id": token.Claims["id"], "username": token.Claims["username"]}, nil
+// revokeRefresh revokes the family of the refresh token in the body of a
+// logout request, if it belongs to the user.
+func (jwts *JwtService) revokeRefresh(request *restful.Request, userId string) error {
+	if jwts.RefreshTokens == nil || request.Request.ContentLength == 0 {
+		return nil
+	}
+	data := bson.M{}
+	if err := request.ReadEntity(&data); err != nil {
+		return nil
+	}
+	refresh, _ := data["refresh_token"].(string)
+	if refresh == "" {
+		return nil
+	}
+	// the token of another user is left untouched
+	stored, err := jwts.RefreshTokens.Find(hashRefreshToken(refresh))
+	if err != nil || stored == nil || stored.UserId != userId {
+		return err
+	}
+	return jwts.RefreshTokens.RevokeFamily(stored.Family)
 }
 
-// MiddlewareFunc makes JWTMiddleware implement the Middleware interface.
-func (jwts *JwtService) MiddlewareFunc(handler HandlerFunc) HandlerFunc {
+// Init
+func (jwts *JwtService) Init() {
 
 	if jwts.Realm == "" {
 		log.Fatal("Realm is required")
@@ -281,54 +715,31 @@ func (jwts *JwtService) MiddlewareFunc(handler HandlerFunc) HandlerFunc {
 	if jwts.SigningAlgorithm == "" {
 		jwts.SigningAlgorithm = "HS256"
 	}
-	if jwts.Key == nil {
-		log.Fatal("Key required")
-	}
 	if jwts.Timeout == 0 {
 		jwts.Timeout = time.Hour
 	}
+	if jwts.Keys == nil {
+		if jwts.Key == nil {
+			log.Fatal("Key or Keys required")
+		}
+		key, err := NewSigningKey("", jwts.SigningAlgorithm, jwts.Key, time.Time{})
+		if err != nil {
+			log.Fatal(err)
+		}
+		jwts.Keys = NewKeySet(jwts.Timeout, key)
+	}
+	if jwts.RefreshTimeout == 0 {
+		jwts.RefreshTimeout = 30 * 24 * time.Hour
+	}
 	if jwts.Authenticator == nil {
 		log.Fatal("Authenticator is required")
 	}
+	if jwts.RefreshTokens != nil && jwts.UserFunc == nil {
+		log.Fatal("UserFunc is required with RefreshTokens")
+	}
 	if jwts.Authorizator == nil {
 		jwts.Authorizator = func(userId string, request *restful.Request) bool {
 			return true
 		}
 	}
-
-	return func(request *restful.Request, response *restful.Response) {
-		jwts.middlewareImpl(request, response, handler)
-	}
-}
-
-func (jwts *JwtService) middlewareImpl(request *restful.Request, response *restful.Response, handler HandlerFunc) {
-	token, err := jwts.parseToken(request)
-
-	if err != nil {
-		jwts.unauthorized(response)
-		return
-	}
-
-	id := token.Claims["id"].(string)
-
-	Env["REMOTE_USER"] = id
-	Env["JWT_PAYLOAD"] = token.Claims
-
-	if !jwts.Authorizator(id, request) {
-		jwts.unauthorized(response)
-		return
-	}
-
-	handler(request, response)
-}
-
-// Helper function to extract the JWT claims
-func ExtractClaims(request *rest.Request) map[string]interface{} {
-	if request.Env["JWT_PAYLOAD"] == nil {
-		empty_claims := make(map[string]interface{})
-		return empty_claims
-	}
-	jwt_claims := request.Env["JWT_PAYLOAD"].(map[string]interface{})
-	return jwt_claims
-
 }
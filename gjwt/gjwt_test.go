@@ -0,0 +1,165 @@
+package gjwt
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/emicklei/go-restful"
+	"gopkg.in/mgo.v2/bson"
+
+	"../apierror"
+)
+
+func TestValidateClaims(t *testing.T) {
+	key, _ := NewSigningKey("", "HS256", []byte("secret"), time.Time{})
+	jwts := newTestService(NewKeySet(time.Hour, key))
+	jwts.Issuer = "https://api.example.com"
+	jwts.Audience = []string{"api", "billing"}
+	jwts.Leeway = time.Minute
+
+	usr := bson.M{"_id": bson.NewObjectId(), "username": "alice"}
+	tokenString, _ := jwts.userToken(usr)
+	token, err := jwts.parseToken(bearerRequest(tokenString))
+	if err != nil {
+		t.Fatalf("Token rejected: %v", err)
+	}
+	if claimsOf(token)["iss"] != jwts.Issuer || claimsOf(token)["sub"] != usr["_id"].(bson.ObjectId).Hex() || claimsOf(token)["nbf"] == nil {
+		t.Errorf("Unexpected claims %v", token.Claims)
+	}
+
+	now := time.Now()
+	for _, test := range []struct {
+		name   string
+		claims map[string]interface{}
+		err    *apierror.Error
+	}{
+		{"skewed", map[string]interface{}{"exp": now.Add(-30 * time.Second).Unix(), "nbf": now.Add(30 * time.Second).Unix()}, nil},
+		{"expired", map[string]interface{}{"exp": now.Add(-2 * time.Minute).Unix()}, ErrTokenExpired},
+		{"not yet valid", map[string]interface{}{"nbf": now.Add(2 * time.Minute).Unix()}, ErrTokenNotYetValid},
+		{"issued in the future", map[string]interface{}{"iat": now.Add(2 * time.Minute).Unix()}, ErrTokenNotYetValid},
+		{"without expiration", map[string]interface{}{"exp": nil}, ErrInvalidToken},
+		{"other issuer", map[string]interface{}{"iss": "https://evil.example.com"}, ErrInvalidIssuer},
+		{"other audience", map[string]interface{}{"aud": []string{"mail"}}, ErrInvalidAudience},
+		{"one of the audiences", map[string]interface{}{"aud": []string{"mail", "billing"}}, nil},
+		{"other subject", map[string]interface{}{"sub": bson.NewObjectId().Hex()}, ErrInvalidToken},
+	} {
+		token := jwts.newToken()
+		jwts.setUserClaims(token, usr)
+		claimsOf(token)["exp"] = now.Add(time.Hour).Unix()
+		for claim, value := range test.claims {
+			if value == nil {
+				delete(claimsOf(token), claim)
+			} else {
+				claimsOf(token)[claim] = value
+			}
+		}
+		tokenString, _ := jwts.sign(token)
+
+		_, err := jwts.parseToken(bearerRequest(tokenString))
+		if test.err == nil && err != nil {
+			t.Errorf("%s: expected the token to be accepted, got %v", test.name, err)
+		}
+		if test.err != nil && apierror.From(err).Code != test.err.Code {
+			t.Errorf("%s: expected %s, got %v", test.name, test.err.Code, err)
+		}
+	}
+}
+
+func TestLogoutInLeeway(t *testing.T) {
+	key, _ := NewSigningKey("", "HS256", []byte("secret"), time.Time{})
+	jwts := newTestService(NewKeySet(time.Hour, key))
+	jwts.Leeway = time.Minute
+	jwts.Revocations = NewMemoryRevocationStore()
+
+	// expired, but still accepted in the leeway
+	token := jwts.newToken()
+	jwts.setUserClaims(token, bson.M{"_id": bson.NewObjectId(), "username": "alice"})
+	claimsOf(token)["exp"] = time.Now().Add(-10 * time.Second).Unix()
+	tokenString, _ := jwts.sign(token)
+
+	ws := new(restful.WebService)
+	ws.Route(ws.POST("/logout").To(jwts.LogoutHandler))
+	container := restful.NewContainer()
+	container.Add(ws)
+	request := httptest.NewRequest("POST", "/logout", nil)
+	request.Header.Set("Authorization", "Bearer "+tokenString)
+	recorder := httptest.NewRecorder()
+	container.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusNoContent {
+		t.Fatalf("Logout failed with %d: %s", recorder.Code, recorder.Body.String())
+	}
+
+	// the next revocation purges the expired ones
+	jwts.Revocations.Revoke(newJti(), time.Now().Add(time.Hour))
+	if _, err := jwts.parseToken(bearerRequest(tokenString)); err != ErrTokenRevoked {
+		t.Errorf("Expected the token to stay revoked in the leeway, got %v", err)
+	}
+}
+
+func TestWriteErrorChallenge(t *testing.T) {
+	jwts := &JwtService{Realm: "api"}
+	for _, test := range []struct {
+		err       error
+		challenge string
+	}{
+		{ErrMissingToken, `Bearer realm="api"`},
+		{ErrTokenExpired, `Bearer realm="api", error="invalid_token", error_description="Token has expired"`},
+		{ErrInvalidAudience, `Bearer realm="api", error="invalid_token", error_description="Token is not intended for this audience"`},
+	} {
+		recorder := httptest.NewRecorder()
+		jwts.writeError(restful.NewResponse(recorder), test.err)
+		if challenge := recorder.Header().Get("WWW-Authenticate"); challenge != test.challenge {
+			t.Errorf("Expected %s, got %s", test.challenge, challenge)
+		}
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	key, _ := NewSigningKey("", "HS256", []byte("secret"), time.Time{})
+	jwts := newTestService(NewKeySet(time.Hour, key))
+	usr := bson.M{"_id": bson.NewObjectId(), "username": "alice"}
+	tokenString, _ := jwts.userToken(usr)
+
+	var principal *Principal
+	handler := func(request *restful.Request, response *restful.Response) {
+		principal = PrincipalOf(request)
+	}
+	ws := new(restful.WebService)
+	ws.Route(ws.GET("/private").Filter(jwts.Authenticate).Filter(jwts.Authenticate).To(handler))
+	ws.Route(ws.GET("/public").Filter(jwts.AuthenticateOptional).To(handler))
+	container := restful.NewContainer()
+	container.Add(ws)
+
+	for _, test := range []struct {
+		path, token string
+		status      int
+		username    string
+	}{
+		{"/private", tokenString, 200, "alice"},
+		{"/private", "", 401, ""},
+		{"/public", "", 200, ""},
+		{"/public", tokenString, 200, "alice"},
+		{"/public", "garbage", 401, ""},
+	} {
+		principal = nil
+		request := httptest.NewRequest("GET", test.path, nil)
+		if test.token != "" {
+			request.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		recorder := httptest.NewRecorder()
+		container.ServeHTTP(recorder, request)
+
+		if recorder.Code != test.status {
+			t.Errorf("%s %q: expected %d, got %d", test.path, test.token, test.status, recorder.Code)
+		}
+		username := ""
+		if principal != nil {
+			username = principal.Username
+		}
+		if username != test.username {
+			t.Errorf("%s: expected principal %q, got %q", test.path, test.username, username)
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package gjwt
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// SigningKey is a key tokens are signed and verified with, identified by the
+// kid header of the tokens. For HMAC, Private and Public are the same secret.
+type SigningKey struct {
+	Id        string
+	Algorithm string
+	// Private is nil for keys that only verify tokens, like retired ones.
+	Private interface{}
+	Public  interface{}
+	// NotBefore is when the key starts signing tokens.
+	NotBefore time.Time
+}
+
+// NewSigningKey checks the key suits the algorithm and derives the public
+// key from a private one. key is a []byte secret for HMAC, else a private or
+// public *rsa, *ecdsa or ed25519 key.
+func NewSigningKey(id, algorithm string, key interface{}, notBefore time.Time) (*SigningKey, error) {
+	sk := &SigningKey{Id: id, Algorithm: algorithm, NotBefore: notBefore}
+	switch k := key.(type) {
+	case []byte:
+		sk.Private, sk.Public = k, k
+	case *rsa.PrivateKey:
+		sk.Private, sk.Public = k, &k.PublicKey
+	case *ecdsa.PrivateKey:
+		sk.Private, sk.Public = k, &k.PublicKey
+	case ed25519.PrivateKey:
+		sk.Private, sk.Public = k, k.Public()
+	default:
+		sk.Public = key
+	}
+	if !keyMatches(algorithm, sk.Public) {
+		return nil, fmt.Errorf("gjwt: key %q is not a %s key", id, algorithm)
+	}
+	return sk, nil
+}
+
+// keyMatches tells whether the public key suits the algorithm, so a public
+// key can never be used as an HMAC secret.
+func keyMatches(algorithm string, public interface{}) bool {
+	switch k := public.(type) {
+	case []byte:
+		return algorithm == "HS256" || algorithm == "HS384" || algorithm == "HS512"
+	case *rsa.PublicKey:
+		switch algorithm {
+		case "RS256", "RS384", "RS512", "PS256", "PS384", "PS512":
+			return true
+		}
+	case *ecdsa.PublicKey:
+		curves := map[string]elliptic.Curve{"ES256": elliptic.P256(), "ES384": elliptic.P384(), "ES512": elliptic.P521()}
+		return curves[algorithm] == k.Curve
+	case ed25519.PublicKey:
+		return algorithm == "EdDSA"
+	}
+	return false
+}
+
+// LoadKey reads a PEM encoded key: a PKCS#8, PKCS#1 or SEC 1 private key, or
+// a PKIX public key for a key that only verifies tokens.
+func LoadKey(id, algorithm, path string, notBefore time.Time) (*SigningKey, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, fmt.Errorf("gjwt: %s is not PEM encoded", path)
+	}
+
+	var key interface{}
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		err = fmt.Errorf("unsupported PEM block %s", block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("gjwt: %s: %v", path, err)
+	}
+	return NewSigningKey(id, algorithm, key, notBefore)
+}
+
+// KeySet holds the keys of a JwtService and rotates them on schedule: the
+// latest key whose NotBefore has passed signs the tokens. A key replaced by a
+// newer one still verifies tokens for Grace, which should be at least the
+// lifetime of the tokens.
+//
+// Keys are published in the JWKS as soon as they are added, so verifiers can
+// fetch them before they start signing.
+type KeySet struct {
+	Grace time.Duration
+
+	mutex sync.RWMutex
+	keys  []*SigningKey
+}
+
+func NewKeySet(grace time.Duration, keys ...*SigningKey) *KeySet {
+	ks := &KeySet{Grace: grace}
+	for _, key := range keys {
+		ks.Add(key)
+	}
+	return ks
+}
+
+func (ks *KeySet) Add(key *SigningKey) {
+	ks.mutex.Lock()
+	defer ks.mutex.Unlock()
+	ks.keys = append(ks.keys, key)
+	sort.SliceStable(ks.keys, func(i, j int) bool { return ks.keys[i].NotBefore.Before(ks.keys[j].NotBefore) })
+}
+
+// SigningKey returns the key signing tokens at now.
+func (ks *KeySet) SigningKey(now time.Time) (*SigningKey, error) {
+	ks.mutex.RLock()
+	defer ks.mutex.RUnlock()
+	for i := len(ks.keys) - 1; i >= 0; i-- {
+		if key := ks.keys[i]; key.Private != nil && !key.NotBefore.After(now) {
+			return key, nil
+		}
+	}
+	return nil, errors.New("gjwt: no signing key is active")
+}
+
+// VerifyingKey returns the key with the given id if it still verifies tokens
+// at now. Tokens without kid are verified by the key without id.
+func (ks *KeySet) VerifyingKey(id string, now time.Time) (*SigningKey, bool) {
+	ks.mutex.RLock()
+	defer ks.mutex.RUnlock()
+	for i, key := range ks.keys {
+		if key.Id == id {
+			return key, !ks.retired(i, now)
+		}
+	}
+	return nil, false
+}
+
+// retired tells whether the i-th key was replaced by a signing key more than
+// Grace ago.
+func (ks *KeySet) retired(i int, now time.Time) bool {
+	for _, next := range ks.keys[i+1:] {
+		if next.Private != nil && next.NotBefore.After(ks.keys[i].NotBefore) && !next.NotBefore.After(now) {
+			return now.After(next.NotBefore.Add(ks.Grace))
+		}
+	}
+	return false
+}
+
+// JWK is a public key in the JSON Web Key format (RFC 7517).
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Crv string `json:"crv,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// JWKS returns the public keys verifying tokens at now, including the ones
+// not signing yet. HMAC secrets are never published.
+func (ks *KeySet) JWKS(now time.Time) []JWK {
+	ks.mutex.RLock()
+	defer ks.mutex.RUnlock()
+
+	jwks := []JWK{}
+	for i, key := range ks.keys {
+		if ks.retired(i, now) {
+			continue
+		}
+		jwk := JWK{Kid: key.Id, Use: "sig", Alg: key.Algorithm}
+		switch k := key.Public.(type) {
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = encodeBigInt(k.N, 0)
+			jwk.E = encodeBigInt(big.NewInt(int64(k.E)), 0)
+		case *ecdsa.PublicKey:
+			size := (k.Curve.Params().BitSize + 7) / 8
+			jwk.Kty, jwk.Crv = "EC", k.Curve.Params().Name
+			jwk.X = encodeBigInt(k.X, size)
+			jwk.Y = encodeBigInt(k.Y, size)
+		case ed25519.PublicKey:
+			jwk.Kty, jwk.Crv = "OKP", "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(k)
+		default:
+			continue
+		}
+		jwks = append(jwks, jwk)
+	}
+	return jwks
+}
+
+// encodeBigInt encodes n big-endian, left padded to size bytes.
+func encodeBigInt(n *big.Int, size int) string {
+	b := n.Bytes()
+	if len(b) < size {
+		b = append(make([]byte, size-len(b)), b...)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// SigningMethodEdDSA signs with Ed25519 keys (RFC 8037), which jwt-go does
+// not provide.
+var SigningMethodEdDSA = signingMethodEdDSA{}
+
+type signingMethodEdDSA struct{}
+
+func init() {
+	jwt.RegisterSigningMethod(SigningMethodEdDSA.Alg(), func() jwt.SigningMethod {
+		return SigningMethodEdDSA
+	})
+}
+
+func (signingMethodEdDSA) Alg() string {
+	return "EdDSA"
+}
+
+func (signingMethodEdDSA) Sign(signingString string, key interface{}) (string, error) {
+	k, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return "", jwt.ErrInvalidKey
+	}
+	return jwt.EncodeSegment(ed25519.Sign(k, []byte(signingString))), nil
+}
+
+func (signingMethodEdDSA) Verify(signingString, signature string, key interface{}) error {
+	k, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return jwt.ErrInvalidKey
+	}
+	sig, err := jwt.DecodeSegment(signature)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(k, []byte(signingString), sig) {
+		return errors.New("gjwt: EdDSA verification failed")
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package gjwt
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/emicklei/go-restful"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// writeKey writes key as a PKCS#8 PEM file and returns its path.
+func writeKey(t *testing.T, dir, name string, key interface{}) string {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, name+".pem")
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func newTestService(keys *KeySet) *JwtService {
+	jwts := &JwtService{
+		Realm: "test",
+		Keys:  keys,
+		Authenticator: func(userId string, password string, request *restful.Request) (bson.M, bool) {
+			return nil, false
+		}}
+	jwts.Init()
+	return jwts
+}
+
+func bearerRequest(token string) *restful.Request {
+	httpRequest, _ := http.NewRequest("GET", "/", nil)
+	httpRequest.Header.Set("Authorization", "Bearer "+token)
+	return restful.NewRequest(httpRequest)
+}
+
+func TestSigningKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gjwt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	usr := bson.M{"_id": bson.NewObjectId(), "username": "alice"}
+
+	for _, test := range []struct {
+		alg string
+		key interface{}
+	}{{"RS256", rsaKey}, {"PS384", rsaKey}, {"ES256", ecKey}, {"EdDSA", edKey}} {
+		key, err := LoadKey("k1", test.alg, writeKey(t, dir, test.alg, test.key), time.Time{})
+		if err != nil {
+			t.Fatalf("%s: %v", test.alg, err)
+		}
+		jwts := newTestService(NewKeySet(time.Hour, key))
+
+		tokenString, err := jwts.userToken(usr)
+		if err != nil {
+			t.Fatalf("%s: %v", test.alg, err)
+		}
+		token, err := jwts.parseToken(bearerRequest(tokenString))
+		if err != nil {
+			t.Fatalf("%s: token rejected: %v", test.alg, err)
+		}
+		if token.Header["kid"] != "k1" || token.Header["alg"] != test.alg {
+			t.Errorf("%s: unexpected header %v", test.alg, token.Header)
+		}
+	}
+
+	if _, err := LoadKey("k1", "ES384", writeKey(t, dir, "p256", ecKey), time.Time{}); err == nil {
+		t.Errorf("Expected a P-256 key to be rejected for ES384")
+	}
+
+	// a public key must never be usable as an HMAC secret
+	key, _ := NewSigningKey("k1", "RS256", rsaKey, time.Time{})
+	jwts := newTestService(NewKeySet(time.Hour, key))
+	forged := jwt.New(jwt.SigningMethodHS256)
+	forged.Header["kid"] = "k1"
+	claimsOf(forged)["id"] = usr["_id"]
+	der, _ := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	forgedString, _ := forged.SignedString(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	if _, err := jwts.parseToken(bearerRequest(forgedString)); err == nil {
+		t.Errorf("Expected a token signed with the public key as HMAC secret to be rejected")
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	now := time.Now()
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	legacy, _ := NewSigningKey("", "HS256", []byte("secret"), time.Time{})
+	current, _ := NewSigningKey("current", "ES256", ecKey, now.Add(-30*time.Minute))
+	next, _ := NewSigningKey("next", "EdDSA", edKey, now.Add(time.Hour))
+	keys := NewKeySet(time.Hour, legacy, next, current)
+
+	if key, _ := keys.SigningKey(now); key != current {
+		t.Errorf("Expected the current key to sign, got %v", key)
+	}
+	if key, _ := keys.SigningKey(now.Add(2 * time.Hour)); key != next {
+		t.Errorf("Expected the next key to sign once started, got %v", key)
+	}
+
+	if _, ok := keys.VerifyingKey("", now); !ok {
+		t.Errorf("Expected the replaced key to verify tokens during the grace period")
+	}
+	if _, ok := keys.VerifyingKey("", now.Add(31*time.Minute)); ok {
+		t.Errorf("Expected the replaced key to be retired after the grace period")
+	}
+	if _, ok := keys.VerifyingKey("current", now.Add(90*time.Minute)); !ok {
+		t.Errorf("Expected the current key to verify tokens after the next key starts")
+	}
+	if _, ok := keys.VerifyingKey("unknown", now); ok {
+		t.Errorf("Expected unknown keys to be rejected")
+	}
+
+	jwks := keys.JWKS(now)
+	if len(jwks) != 2 || jwks[0].Kid != "current" || jwks[1].Kid != "next" {
+		t.Fatalf("Expected the current and next public keys, got %+v", jwks)
+	}
+	if jwks[0].Kty != "EC" || jwks[0].Crv != "P-256" || len(jwks[0].X) != 43 || len(jwks[0].Y) != 43 {
+		t.Errorf("Unexpected EC key %+v", jwks[0])
+	}
+	if jwks[1].Kty != "OKP" || jwks[1].Crv != "Ed25519" || jwks[1].X == "" {
+		t.Errorf("Unexpected Ed25519 key %+v", jwks[1])
+	}
+}
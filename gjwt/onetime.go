@@ -0,0 +1,154 @@
+package gjwt
+
+import (
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Purposes of the one-time tokens.
+const (
+	PurposeVerifyEmail   = "verify_email"
+	PurposeResetPassword = "reset_password"
+)
+
+// OneTimeToken is the server side record of a token mailed to a user, like
+// to verify their email address or reset their password. Only the hash of
+// the token is stored.
+type OneTimeToken struct {
+	Hash    string `bson:"_id"`
+	Purpose string `bson:"purpose"`
+	UserId  string `bson:"user_id"`
+	// Email is the address the token was sent to.
+	Email     string    `bson:"email,omitempty"`
+	ExpiresAt time.Time `bson:"expires_at"`
+}
+
+// OneTimeStore keeps the one-time tokens until they are used or expire.
+type OneTimeStore interface {
+	Save(token *OneTimeToken) error
+	// Use removes the token and returns it, so that it works once. It
+	// returns nil for unknown tokens and tokens of another purpose.
+	Use(purpose, hash string) (*OneTimeToken, error)
+	// Revoke removes the tokens of the user for the purpose, like when a new
+	// one is sent.
+	Revoke(purpose, userId string) error
+}
+
+// NewOneTimeToken returns an opaque token for the user, to send them, and its
+// record, to save.
+func NewOneTimeToken(purpose, userId, email string, timeout time.Duration) (string, *OneTimeToken) {
+	token, hash := newRefreshToken()
+	return token, &OneTimeToken{Hash: hash, Purpose: purpose, UserId: userId, Email: email, ExpiresAt: time.Now().Add(timeout)}
+}
+
+// HashOneTimeToken returns the hash a token is stored by.
+func HashOneTimeToken(token string) string {
+	return hashRefreshToken(token)
+}
+
+type MemoryOneTimeStore struct {
+	mutex  sync.Mutex
+	tokens map[string]OneTimeToken
+}
+
+func NewMemoryOneTimeStore() *MemoryOneTimeStore {
+	return &MemoryOneTimeStore{tokens: map[string]OneTimeToken{}}
+}
+
+func (ms *MemoryOneTimeStore) Save(token *OneTimeToken) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	now := time.Now()
+	for hash, t := range ms.tokens {
+		if t.ExpiresAt.Before(now) {
+			delete(ms.tokens, hash)
+		}
+	}
+	ms.tokens[token.Hash] = *token
+	return nil
+}
+
+func (ms *MemoryOneTimeStore) Use(purpose, hash string) (*OneTimeToken, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	token, ok := ms.tokens[hash]
+	if !ok || token.Purpose != purpose {
+		return nil, nil
+	}
+	delete(ms.tokens, hash)
+	return &token, nil
+}
+
+func (ms *MemoryOneTimeStore) Revoke(purpose, userId string) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	for hash, t := range ms.tokens {
+		if t.Purpose == purpose && t.UserId == userId {
+			delete(ms.tokens, hash)
+		}
+	}
+	return nil
+}
+
+// MgoOneTimeStore keeps the one-time tokens in Mongo, removed by a TTL index
+// once expired.
+type MgoOneTimeStore struct {
+	session *mgo.Session
+	db      string
+}
+
+const oneTimeTokensCollection = "one_time_tokens"
+
+func NewMgoOneTimeStore(session *mgo.Session, db string) (*MgoOneTimeStore, error) {
+	ms := &MgoOneTimeStore{session: session, db: db}
+	err := ms.with(func(c *mgo.Collection) error {
+		if err := c.EnsureIndex(mgo.Index{Key: []string{"expires_at"}, ExpireAfter: time.Second}); err != nil {
+			return err
+		}
+		return c.EnsureIndexKey("user_id", "purpose")
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ms, nil
+}
+
+func (ms *MgoOneTimeStore) with(op func(c *mgo.Collection) error) error {
+	session := ms.session.Copy()
+	defer session.Close()
+	return op(session.DB(ms.db).C(oneTimeTokensCollection))
+}
+
+func (ms *MgoOneTimeStore) Save(token *OneTimeToken) error {
+	return ms.with(func(c *mgo.Collection) error {
+		return c.Insert(token)
+	})
+}
+
+// Use atomically removes the token, so concurrent uses of the same token
+// cannot both succeed. Expired tokens not yet removed by the TTL monitor are
+// left for the caller to reject.
+func (ms *MgoOneTimeStore) Use(purpose, hash string) (token *OneTimeToken, err error) {
+	err = ms.with(func(c *mgo.Collection) error {
+		token = &OneTimeToken{}
+		_, err := c.Find(bson.M{"_id": hash, "purpose": purpose}).Apply(mgo.Change{Remove: true}, token)
+		if err == mgo.ErrNotFound {
+			token = nil
+			return nil
+		}
+		return err
+	})
+	return token, err
+}
+
+func (ms *MgoOneTimeStore) Revoke(purpose, userId string) error {
+	return ms.with(func(c *mgo.Collection) error {
+		_, err := c.RemoveAll(bson.M{"purpose": purpose, "user_id": userId})
+		return err
+	})
+}
@@ -0,0 +1,92 @@
+package gjwt
+
+import (
+	"github.com/emicklei/go-restful"
+
+	"../apierror"
+)
+
+const attrPrincipal = "gjwt.principal"
+
+// Principal is the user a request is authenticated as, read from the claims
+// of its token.
+type Principal struct {
+	Id          string
+	Username    string
+	Roles       []string
+	Permissions []string
+	// Claims are all the claims of the token, including the ones added by
+	// PayloadFunc and UserClaimsFunc.
+	Claims map[string]interface{}
+}
+
+// PrincipalOf returns the principal set by the authentication filters, nil
+// for anonymous requests.
+func PrincipalOf(request *restful.Request) *Principal {
+	principal, _ := request.Attribute(attrPrincipal).(*Principal)
+	return principal
+}
+
+// Authenticate is a filter letting through only the requests with a valid
+// token, and storing their Principal. Routes opt in by adding it, to a route
+// or to a whole WebService:
+//
+//	ws.Route(ws.GET("/me").Filter(jwts.Authenticate).To(me))
+func (jwts *JwtService) Authenticate(request *restful.Request, response *restful.Response, chain *restful.FilterChain) {
+	if _, err := jwts.authenticate(request); err != nil {
+		jwts.writeError(response, err)
+		return
+	}
+	chain.ProcessFilter(request, response)
+}
+
+// AuthenticateOptional is a filter storing the Principal of requests with a
+// token, and letting anonymous ones through. Invalid tokens are rejected.
+func (jwts *JwtService) AuthenticateOptional(request *restful.Request, response *restful.Response, chain *restful.FilterChain) {
+	if request.HeaderParameter("Authorization") != "" {
+		if _, err := jwts.authenticate(request); err != nil {
+			jwts.writeError(response, err)
+			return
+		}
+	}
+	chain.ProcessFilter(request, response)
+}
+
+// authenticate verifies the token of the request once: the principal is kept
+// in the request attributes for the next filters and the handler.
+func (jwts *JwtService) authenticate(request *restful.Request) (*Principal, error) {
+	if principal := PrincipalOf(request); principal != nil {
+		return principal, nil
+	}
+
+	token, err := jwts.parseToken(request)
+	if err == nil && jwts.MaxRefresh != 0 {
+		err = jwts.checkRefresh(token)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	principal := &Principal{Claims: claimsOf(token)}
+	principal.Id, _ = claimsOf(token)["id"].(string)
+	principal.Username, _ = claimsOf(token)["username"].(string)
+	principal.Roles = stringList(claimsOf(token)["roles"])
+	principal.Permissions = stringList(claimsOf(token)["permissions"])
+	if !jwts.Authorizator(principal.Id, request) {
+		return nil, apierror.ErrForbidden
+	}
+
+	request.SetAttribute(attrPrincipal, principal)
+	return principal, nil
+}
+
+func stringList(value interface{}) []string {
+	list := []string{}
+	values, _ := value.([]interface{})
+	for _, v := range values {
+		if s, ok := v.(string); ok {
+			list = append(list, s)
+		}
+	}
+	return list
+}
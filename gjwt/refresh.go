@@ -0,0 +1,201 @@
+package gjwt
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// RefreshToken is the server side record of an opaque refresh token. Only
+// the hash of the token is stored. Every token descending from the same login
+// shares its Family, so reusing a rotated token can revoke them all.
+type RefreshToken struct {
+	Hash      string    `bson:"_id"`
+	UserId    string    `bson:"user_id"`
+	Family    string    `bson:"family"`
+	ExpiresAt time.Time `bson:"expires_at"`
+	Used      bool      `bson:"used"`
+}
+
+// RefreshStore keeps the refresh tokens until they expire.
+type RefreshStore interface {
+	Save(token *RefreshToken) error
+	// Use marks the token used and returns it as it was, so that a token
+	// used twice is seen used by the second caller. It returns nil for
+	// unknown tokens.
+	Use(hash string) (*RefreshToken, error)
+	// Find returns the token without using it, or nil for unknown tokens.
+	Find(hash string) (*RefreshToken, error)
+	RevokeFamily(family string) error
+	RevokeUser(userId string) error
+}
+
+// newRefreshToken returns an opaque token and its hash.
+func newRefreshToken() (token, hash string) {
+	b := make([]byte, 32)
+	rand.Read(b)
+	token = base64.RawURLEncoding.EncodeToString(b)
+	return token, hashRefreshToken(token)
+}
+
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+type MemoryRefreshStore struct {
+	mutex  sync.Mutex
+	tokens map[string]RefreshToken
+}
+
+func NewMemoryRefreshStore() *MemoryRefreshStore {
+	return &MemoryRefreshStore{tokens: map[string]RefreshToken{}}
+}
+
+func (ms *MemoryRefreshStore) Save(token *RefreshToken) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	now := time.Now()
+	for hash, t := range ms.tokens {
+		if t.ExpiresAt.Before(now) {
+			delete(ms.tokens, hash)
+		}
+	}
+	ms.tokens[token.Hash] = *token
+	return nil
+}
+
+func (ms *MemoryRefreshStore) Use(hash string) (*RefreshToken, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	token, ok := ms.tokens[hash]
+	if !ok {
+		return nil, nil
+	}
+	used := token
+	used.Used = true
+	ms.tokens[hash] = used
+	return &token, nil
+}
+
+func (ms *MemoryRefreshStore) Find(hash string) (*RefreshToken, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	token, ok := ms.tokens[hash]
+	if !ok {
+		return nil, nil
+	}
+	return &token, nil
+}
+
+func (ms *MemoryRefreshStore) RevokeFamily(family string) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	for hash, t := range ms.tokens {
+		if t.Family == family {
+			delete(ms.tokens, hash)
+		}
+	}
+	return nil
+}
+
+func (ms *MemoryRefreshStore) RevokeUser(userId string) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	for hash, t := range ms.tokens {
+		if t.UserId == userId {
+			delete(ms.tokens, hash)
+		}
+	}
+	return nil
+}
+
+// MgoRefreshStore keeps the refresh tokens in Mongo, removed by a TTL index
+// once expired.
+type MgoRefreshStore struct {
+	session *mgo.Session
+	db      string
+}
+
+const refreshTokensCollection = "refresh_tokens"
+
+func NewMgoRefreshStore(session *mgo.Session, db string) (*MgoRefreshStore, error) {
+	ms := &MgoRefreshStore{session: session, db: db}
+	err := ms.with(func(c *mgo.Collection) error {
+		if err := c.EnsureIndex(mgo.Index{Key: []string{"expires_at"}, ExpireAfter: time.Second}); err != nil {
+			return err
+		}
+		if err := c.EnsureIndexKey("family"); err != nil {
+			return err
+		}
+		return c.EnsureIndexKey("user_id")
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ms, nil
+}
+
+func (ms *MgoRefreshStore) with(op func(c *mgo.Collection) error) error {
+	session := ms.session.Copy()
+	defer session.Close()
+	return op(session.DB(ms.db).C(refreshTokensCollection))
+}
+
+func (ms *MgoRefreshStore) Save(token *RefreshToken) error {
+	return ms.with(func(c *mgo.Collection) error {
+		return c.Insert(token)
+	})
+}
+
+// Use atomically marks the token used, so concurrent uses of the same token
+// cannot both succeed. Expired tokens not yet removed by the TTL monitor are
+// left for the caller to reject.
+func (ms *MgoRefreshStore) Use(hash string) (token *RefreshToken, err error) {
+	err = ms.with(func(c *mgo.Collection) error {
+		token = &RefreshToken{}
+		_, err := c.FindId(hash).Apply(mgo.Change{Update: bson.M{"$set": bson.M{"used": true}}}, token)
+		if err == mgo.ErrNotFound {
+			token = nil
+			return nil
+		}
+		return err
+	})
+	return token, err
+}
+
+func (ms *MgoRefreshStore) Find(hash string) (token *RefreshToken, err error) {
+	err = ms.with(func(c *mgo.Collection) error {
+		token = &RefreshToken{}
+		err := c.FindId(hash).One(token)
+		if err == mgo.ErrNotFound {
+			token = nil
+			return nil
+		}
+		return err
+	})
+	return token, err
+}
+
+func (ms *MgoRefreshStore) RevokeFamily(family string) error {
+	return ms.with(func(c *mgo.Collection) error {
+		_, err := c.RemoveAll(bson.M{"family": family})
+		return err
+	})
+}
+
+func (ms *MgoRefreshStore) RevokeUser(userId string) error {
+	return ms.with(func(c *mgo.Collection) error {
+		_, err := c.RemoveAll(bson.M{"user_id": userId})
+		return err
+	})
+}
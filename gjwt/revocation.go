@@ -0,0 +1,141 @@
+package gjwt
+
+import (
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// RevocationStore remembers the tokens revoked before they expire, by jti, and
+// per user watermarks invalidating every token issued before them.
+type RevocationStore interface {
+	// Revoke invalidates the token with the given jti; it can be forgotten
+	// once the token expires.
+	Revoke(jti string, expires time.Time) error
+	IsRevoked(jti string) (bool, error)
+	// RevokeBefore invalidates the tokens of the user issued before t.
+	RevokeBefore(userId string, t time.Time) error
+	// RevokedBefore returns the watermark of the user, the zero time if none.
+	RevokedBefore(userId string) (time.Time, error)
+}
+
+// MemoryRevocationStore keeps revocations in memory, for tests and single
+// instance deployments.
+type MemoryRevocationStore struct {
+	mutex      sync.Mutex
+	tokens     map[string]time.Time
+	watermarks map[string]time.Time
+}
+
+func NewMemoryRevocationStore() *MemoryRevocationStore {
+	return &MemoryRevocationStore{tokens: map[string]time.Time{}, watermarks: map[string]time.Time{}}
+}
+
+func (ms *MemoryRevocationStore) Revoke(jti string, expires time.Time) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	now := time.Now()
+	for id, exp := range ms.tokens {
+		if exp.Before(now) {
+			delete(ms.tokens, id)
+		}
+	}
+	ms.tokens[jti] = expires
+	return nil
+}
+
+func (ms *MemoryRevocationStore) IsRevoked(jti string) (bool, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	_, ok := ms.tokens[jti]
+	return ok, nil
+}
+
+func (ms *MemoryRevocationStore) RevokeBefore(userId string, t time.Time) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	if t.After(ms.watermarks[userId]) {
+		ms.watermarks[userId] = t
+	}
+	return nil
+}
+
+func (ms *MemoryRevocationStore) RevokedBefore(userId string) (time.Time, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	return ms.watermarks[userId], nil
+}
+
+// MgoRevocationStore keeps revocations in Mongo so they are shared by every
+// instance. Revoked tokens are removed by a TTL index once expired.
+type MgoRevocationStore struct {
+	session *mgo.Session
+	db      string
+}
+
+const (
+	revokedTokensCollection = "revoked_tokens"
+	watermarksCollection    = "token_watermarks"
+)
+
+// NewMgoRevocationStore uses copies of session on the database db and
+// creates the TTL index.
+func NewMgoRevocationStore(session *mgo.Session, db string) (*MgoRevocationStore, error) {
+	ms := &MgoRevocationStore{session: session, db: db}
+	session = ms.session.Copy()
+	defer session.Close()
+	err := session.DB(db).C(revokedTokensCollection).EnsureIndex(mgo.Index{
+		Key: []string{"expires_at"}, ExpireAfter: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	return ms, nil
+}
+
+func (ms *MgoRevocationStore) with(collectionName string, op func(c *mgo.Collection) error) error {
+	session := ms.session.Copy()
+	defer session.Close()
+	return op(session.DB(ms.db).C(collectionName))
+}
+
+func (ms *MgoRevocationStore) Revoke(jti string, expires time.Time) error {
+	return ms.with(revokedTokensCollection, func(c *mgo.Collection) error {
+		_, err := c.UpsertId(jti, bson.M{"_id": jti, "expires_at": expires})
+		return err
+	})
+}
+
+// IsRevoked also checks the expiry since the TTL monitor only runs every minute.
+func (ms *MgoRevocationStore) IsRevoked(jti string) (revoked bool, err error) {
+	err = ms.with(revokedTokensCollection, func(c *mgo.Collection) error {
+		count, err := c.Find(bson.M{"_id": jti, "expires_at": bson.M{"$gt": time.Now()}}).Count()
+		revoked = count > 0
+		return err
+	})
+	return revoked, err
+}
+
+func (ms *MgoRevocationStore) RevokeBefore(userId string, t time.Time) error {
+	return ms.with(watermarksCollection, func(c *mgo.Collection) error {
+		_, err := c.UpsertId(userId, bson.M{"$max": bson.M{"revoked_before": t}})
+		return err
+	})
+}
+
+func (ms *MgoRevocationStore) RevokedBefore(userId string) (t time.Time, err error) {
+	err = ms.with(watermarksCollection, func(c *mgo.Collection) error {
+		doc := struct {
+			RevokedBefore time.Time `bson:"revoked_before"`
+		}{}
+		err := c.FindId(userId).One(&doc)
+		if err == mgo.ErrNotFound {
+			return nil
+		}
+		t = doc.RevokedBefore
+		return err
+	})
+	return t, err
+}
@@ -0,0 +1,359 @@
+package gjwt
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/emicklei/go-restful"
+
+	"../apierror"
+)
+
+var (
+	ErrTooManyAttempts = apierror.New(http.StatusTooManyRequests, "too_many_attempts", "Too many failed logins, retry later")
+	ErrAccountLocked   = apierror.New(http.StatusTooManyRequests, "account_locked", "Account is temporarily locked after too many failed logins")
+)
+
+// Reasons of the failed logins in the audit trail.
+const (
+	ReasonInvalidCredentials = "invalid_credentials"
+	ReasonThrottled          = "throttled"
+	ReasonLocked             = "locked"
+)
+
+// LoginThrottle slows down password guessing on LoginHandler. Failed logins
+// are counted per client IP and per account: past FreeAttempts failures in a
+// row, each failure doubles the wait before the next attempt, from BaseDelay
+// up to MaxDelay, and LockoutThreshold failures lock the account for
+// LockoutDuration. Attempts made too early get 429 with Retry-After, before
+// the password is checked.
+type LoginThrottle struct {
+	FreeAttempts int
+	BaseDelay    time.Duration
+	MaxDelay     time.Duration
+	// LockoutThreshold is 0 to never lock accounts.
+	LockoutThreshold int
+	LockoutDuration  time.Duration
+
+	// IPs counts the failures per client IP. Successful logins do not reset
+	// them, so one IP cannot try many accounts.
+	IPs AttemptStore
+	// Accounts counts the failures per username, reset on success.
+	Accounts AttemptStore
+	// AccountsFor returns the store of Accounts for a login request, like
+	// when the accounts live in a collection scoped to the request.
+	// Optional, by default Accounts is used.
+	AccountsFor func(request *restful.Request) AttemptStore
+	// Audit records every failed attempt. Optional.
+	Audit AuditLog
+}
+
+// For returns the throttle of a login request.
+func (lt *LoginThrottle) For(request *restful.Request) *LoginThrottle {
+	if lt.AccountsFor == nil {
+		return lt
+	}
+	throttle := *lt
+	throttle.Accounts = lt.AccountsFor(request)
+	return &throttle
+}
+
+// Attempts are the failed logins in a row of a client IP or an account.
+type Attempts struct {
+	Failures    int       `bson:"failures"`
+	LastFailure time.Time `bson:"last_failure"`
+	LockedUntil time.Time `bson:"locked_until,omitempty"`
+}
+
+// AttemptStore counts failed logins. Failures older than the window of the
+// store are forgotten.
+type AttemptStore interface {
+	Attempts(key string) (Attempts, error)
+	// Fail counts a failed login at t.
+	Fail(key string, t time.Time) (Attempts, error)
+	// Lock refuses logins until the given time and restarts the count.
+	Lock(key string, until time.Time) error
+	Reset(key string) error
+}
+
+// FailedLogin is an entry of the audit trail.
+type FailedLogin struct {
+	Username  string    `bson:"username"`
+	IP        string    `bson:"ip"`
+	UserAgent string    `bson:"user_agent"`
+	Reason    string    `bson:"reason"`
+	At        time.Time `bson:"at"`
+}
+
+type AuditLog interface {
+	Record(attempt *FailedLogin) error
+}
+
+// ClientIP returns the address the request comes from.
+func ClientIP(request *http.Request) string {
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		return request.RemoteAddr
+	}
+	return host
+}
+
+// Check returns ErrTooManyAttempts or ErrAccountLocked, and how long to wait,
+// when the next attempt for the account from the IP comes too early.
+func (lt *LoginThrottle) Check(username, ip string, now time.Time) (time.Duration, error) {
+	ipAttempts, err := lt.IPs.Attempts(ip)
+	if err != nil {
+		return 0, apierror.ErrInternal.WithCause(err)
+	}
+	accountAttempts, err := lt.Accounts.Attempts(username)
+	if err != nil {
+		return 0, apierror.ErrInternal.WithCause(err)
+	}
+
+	if accountAttempts.LockedUntil.After(now) {
+		return accountAttempts.LockedUntil.Sub(now), ErrAccountLocked
+	}
+	wait := lt.backoff(ipAttempts, now)
+	if accountWait := lt.backoff(accountAttempts, now); accountWait > wait {
+		wait = accountWait
+	}
+	if wait > 0 {
+		return wait, ErrTooManyAttempts
+	}
+	return 0, nil
+}
+
+// backoff returns how long to wait after the last failure, doubling with each
+// failure past FreeAttempts.
+func (lt *LoginThrottle) backoff(attempts Attempts, now time.Time) time.Duration {
+	if attempts.Failures < lt.FreeAttempts || attempts.Failures == 0 {
+		return 0
+	}
+	delay := lt.BaseDelay
+	for i := lt.FreeAttempts; i < attempts.Failures && delay < lt.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > lt.MaxDelay {
+		delay = lt.MaxDelay
+	}
+	if wait := attempts.LastFailure.Add(delay).Sub(now); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// Failed counts a failed login and locks the account past LockoutThreshold.
+func (lt *LoginThrottle) Failed(username, ip string, now time.Time) error {
+	if _, err := lt.IPs.Fail(ip, now); err != nil {
+		return err
+	}
+	attempts, err := lt.Accounts.Fail(username, now)
+	if err != nil {
+		return err
+	}
+	if lt.LockoutThreshold > 0 && attempts.Failures >= lt.LockoutThreshold {
+		return lt.Accounts.Lock(username, now.Add(lt.LockoutDuration))
+	}
+	return nil
+}
+
+// Succeeded forgets the failures of the account.
+func (lt *LoginThrottle) Succeeded(username string) error {
+	return lt.Accounts.Reset(username)
+}
+
+func (lt *LoginThrottle) record(attempt *FailedLogin) error {
+	if lt.Audit == nil {
+		return nil
+	}
+	return lt.Audit.Record(attempt)
+}
+
+type MemoryAttemptStore struct {
+	window   time.Duration
+	mutex    sync.Mutex
+	attempts map[string]Attempts
+}
+
+func NewMemoryAttemptStore(window time.Duration) *MemoryAttemptStore {
+	return &MemoryAttemptStore{window: window, attempts: map[string]Attempts{}}
+}
+
+func (ms *MemoryAttemptStore) Attempts(key string) (Attempts, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	return ms.current(key, time.Now()), nil
+}
+
+// current returns the attempts of key, forgetting the failures out of the
+// window.
+func (ms *MemoryAttemptStore) current(key string, now time.Time) Attempts {
+	attempts := ms.attempts[key]
+	if now.Sub(attempts.LastFailure) > ms.window {
+		attempts.Failures = 0
+	}
+	return attempts
+}
+
+func (ms *MemoryAttemptStore) Fail(key string, t time.Time) (Attempts, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	for k, attempts := range ms.attempts {
+		if t.Sub(attempts.LastFailure) > ms.window && attempts.LockedUntil.Before(t) {
+			delete(ms.attempts, k)
+		}
+	}
+	attempts := ms.current(key, t)
+	attempts.Failures++
+	attempts.LastFailure = t
+	ms.attempts[key] = attempts
+	return attempts, nil
+}
+
+func (ms *MemoryAttemptStore) Lock(key string, until time.Time) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	attempts := ms.attempts[key]
+	attempts.Failures = 0
+	attempts.LockedUntil = until
+	ms.attempts[key] = attempts
+	return nil
+}
+
+func (ms *MemoryAttemptStore) Reset(key string) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	delete(ms.attempts, key)
+	return nil
+}
+
+// MgoAttemptStore counts the failed logins in Mongo, so every instance of the
+// API sees them. A TTL index removes the counts out of the window.
+type MgoAttemptStore struct {
+	session *mgo.Session
+	db      string
+	window  time.Duration
+}
+
+const loginAttemptsCollection = "login_attempts"
+
+func NewMgoAttemptStore(session *mgo.Session, db string, window time.Duration) (*MgoAttemptStore, error) {
+	ms := &MgoAttemptStore{session: session, db: db, window: window}
+	err := ms.with(func(c *mgo.Collection) error {
+		return c.EnsureIndex(mgo.Index{Key: []string{"expires_at"}, ExpireAfter: time.Second})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ms, nil
+}
+
+func (ms *MgoAttemptStore) with(op func(c *mgo.Collection) error) error {
+	session := ms.session.Copy()
+	defer session.Close()
+	return op(session.DB(ms.db).C(loginAttemptsCollection))
+}
+
+func (ms *MgoAttemptStore) Attempts(key string) (attempts Attempts, err error) {
+	err = ms.with(func(c *mgo.Collection) error {
+		err := c.FindId(key).One(&attempts)
+		if err == mgo.ErrNotFound {
+			return nil
+		}
+		return err
+	})
+	if time.Since(attempts.LastFailure) > ms.window {
+		attempts.Failures = 0
+	}
+	return attempts, err
+}
+
+// Fail increments the count atomically, restarting it when the last failure
+// is out of the window but not yet removed by the TTL monitor.
+func (ms *MgoAttemptStore) Fail(key string, t time.Time) (attempts Attempts, err error) {
+	err = ms.with(func(c *mgo.Collection) error {
+		set := bson.M{"last_failure": t, "expires_at": t.Add(ms.window)}
+		_, err := c.Find(bson.M{"_id": key, "last_failure": bson.M{"$gte": t.Add(-ms.window)}}).
+			Apply(mgo.Change{Update: bson.M{"$inc": bson.M{"failures": 1}, "$set": set}, ReturnNew: true}, &attempts)
+		if err != mgo.ErrNotFound {
+			return err
+		}
+		set["failures"] = 1
+		_, err = c.UpsertId(key, bson.M{"$set": set})
+		attempts = Attempts{Failures: 1, LastFailure: t}
+		return err
+	})
+	return attempts, err
+}
+
+func (ms *MgoAttemptStore) Lock(key string, until time.Time) error {
+	return ms.with(func(c *mgo.Collection) error {
+		_, err := c.UpsertId(key, bson.M{"$set": bson.M{"failures": 0, "locked_until": until, "expires_at": until.Add(ms.window)}})
+		return err
+	})
+}
+
+func (ms *MgoAttemptStore) Reset(key string) error {
+	return ms.with(func(c *mgo.Collection) error {
+		err := c.RemoveId(key)
+		if err == mgo.ErrNotFound {
+			return nil
+		}
+		return err
+	})
+}
+
+type MemoryAuditLog struct {
+	mutex    sync.Mutex
+	Failures []FailedLogin
+}
+
+func (ml *MemoryAuditLog) Record(attempt *FailedLogin) error {
+	ml.mutex.Lock()
+	defer ml.mutex.Unlock()
+	ml.Failures = append(ml.Failures, *attempt)
+	return nil
+}
+
+// MgoAuditLog keeps the failed logins in Mongo for the retention period.
+type MgoAuditLog struct {
+	session *mgo.Session
+	db      string
+}
+
+const loginFailuresCollection = "login_failures"
+
+func NewMgoAuditLog(session *mgo.Session, db string, retention time.Duration) (*MgoAuditLog, error) {
+	ml := &MgoAuditLog{session: session, db: db}
+	err := ml.with(func(c *mgo.Collection) error {
+		if err := c.EnsureIndex(mgo.Index{Key: []string{"at"}, ExpireAfter: retention}); err != nil {
+			return err
+		}
+		if err := c.EnsureIndexKey("username", "at"); err != nil {
+			return err
+		}
+		return c.EnsureIndexKey("ip", "at")
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ml, nil
+}
+
+func (ml *MgoAuditLog) with(op func(c *mgo.Collection) error) error {
+	session := ml.session.Copy()
+	defer session.Close()
+	return op(session.DB(ml.db).C(loginFailuresCollection))
+}
+
+func (ml *MgoAuditLog) Record(attempt *FailedLogin) error {
+	return ml.with(func(c *mgo.Collection) error {
+		return c.Insert(attempt)
+	})
+}
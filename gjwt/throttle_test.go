@@ -0,0 +1,53 @@
+package gjwt
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoginThrottle(t *testing.T) {
+	lt := &LoginThrottle{
+		FreeAttempts:     2,
+		BaseDelay:        time.Second,
+		MaxDelay:         5 * time.Second,
+		LockoutThreshold: 6,
+		LockoutDuration:  time.Minute,
+		IPs:              NewMemoryAttemptStore(time.Hour),
+		Accounts:         NewMemoryAttemptStore(time.Hour)}
+	now := time.Now()
+
+	// the account backs off 0, 0, 1, 2, 4, then 5 seconds after each failure
+	for i, expected := range []time.Duration{0, 0, 1, 2, 4, 5} {
+		wait, err := lt.Check("alice", "192.0.2.1", now)
+		if wait != expected*time.Second {
+			t.Fatalf("Failure %d: expected to wait %ds, got %s (%v)", i, expected, wait, err)
+		}
+		now = now.Add(wait)
+		lt.Failed("alice", "192.0.2.1", now)
+	}
+
+	// the IP is throttled for other accounts too
+	if wait, err := lt.Check("bob", "192.0.2.1", now); err != ErrTooManyAttempts || wait != 5*time.Second {
+		t.Errorf("Expected the IP to be throttled, got %s %v", wait, err)
+	}
+	if wait, err := lt.Check("bob", "192.0.2.2", now); err != nil || wait != 0 {
+		t.Errorf("Expected another account from another IP to pass, got %s %v", wait, err)
+	}
+
+	// the sixth failure locked the account, until it unlocks on its own
+	if wait, err := lt.Check("alice", "192.0.2.2", now); err != ErrAccountLocked || wait != time.Minute {
+		t.Errorf("Expected the account to be locked, got %s %v", wait, err)
+	}
+	if wait, err := lt.Check("alice", "192.0.2.2", now.Add(time.Minute)); err != nil || wait != 0 {
+		t.Errorf("Expected the account to be unlocked, got %s %v", wait, err)
+	}
+
+	lt.Failed("carol", "192.0.2.3", now)
+	lt.Succeeded("carol")
+	if attempts, _ := lt.Accounts.Attempts("carol"); attempts.Failures != 0 {
+		t.Errorf("Expected a successful login to reset the account, got %d failures", attempts.Failures)
+	}
+	if attempts, _ := lt.IPs.Attempts("192.0.2.3"); attempts.Failures != 1 {
+		t.Errorf("Expected a successful login not to reset the IP, got %d failures", attempts.Failures)
+	}
+}
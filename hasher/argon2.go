@@ -0,0 +1,81 @@
+package hasher
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Argon2id encodes hashes as $argon2id$v=19$m=<memory KiB>,t=<time>,p=<threads>$<salt>$<hash>.
+type Argon2id struct {
+	Memory  uint32
+	Time    uint32
+	Threads uint8
+	SaltLen int
+	KeyLen  uint32
+}
+
+func NewArgon2id() *Argon2id {
+	return &Argon2id{Memory: 64 * 1024, Time: 3, Threads: 2, SaltLen: 16, KeyLen: 32}
+}
+
+func (a *Argon2id) Identify(encoded string) bool {
+	return strings.HasPrefix(encoded, "$argon2id$")
+}
+
+func (a *Argon2id) Hash(password string) (string, error) {
+	salt, err := genSalt(a.SaltLen)
+	if err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, a.Time, a.Memory, a.Threads, a.KeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, a.Memory, a.Time, a.Threads, encodeBase64(salt), encodeBase64(key)), nil
+}
+
+func (a *Argon2id) Verify(password, encoded string) (bool, error) {
+	params, salt, key, err := a.decode(encoded)
+	if err != nil {
+		return false, err
+	}
+	other := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(key, other) == 1, nil
+}
+
+func (a *Argon2id) NeedsRehash(encoded string) bool {
+	params, salt, key, err := a.decode(encoded)
+	if err != nil {
+		return true
+	}
+	return params.Memory < a.Memory || params.Time < a.Time || params.Threads < a.Threads ||
+		len(salt) < a.SaltLen || uint32(len(key)) < a.KeyLen
+}
+
+func (a *Argon2id) decode(encoded string) (*Argon2id, []byte, []byte, error) {
+	parts, err := splitEncoded(encoded, 5)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[1], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, nil, nil, ErrInvalidHash
+	}
+
+	params := &Argon2id{}
+	if _, err := fmt.Sscanf(parts[2], "m=%d,t=%d,p=%d", &params.Memory, &params.Time, &params.Threads); err != nil {
+		return nil, nil, nil, ErrInvalidHash
+	}
+
+	salt, err := decodeBase64(parts[3])
+	if err != nil {
+		return nil, nil, nil, ErrInvalidHash
+	}
+	key, err := decodeBase64(parts[4])
+	if err != nil {
+		return nil, nil, nil, ErrInvalidHash
+	}
+	return params, salt, key, nil
+}
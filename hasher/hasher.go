@@ -0,0 +1,89 @@
+package hasher
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"strings"
+)
+
+var (
+	ErrInvalidHash = errors.New("Invalid password hash")
+)
+
+// Hasher is one password hashing scheme. Encoded hashes are self-describing:
+// they carry the algorithm, its cost parameters and the salt.
+type Hasher interface {
+	// Identify tells whether the encoded hash was produced by this scheme.
+	Identify(encoded string) bool
+
+	Hash(password string) (string, error)
+
+	Verify(password, encoded string) (bool, error)
+
+	// NeedsRehash tells whether the encoded hash uses weaker parameters than
+	// the ones the hasher is configured with.
+	NeedsRehash(encoded string) bool
+}
+
+// Manager hashes new passwords with its default hasher and verifies hashes
+// produced by any of the hashers it knows about.
+type Manager struct {
+	Default Hasher
+	hashers []Hasher
+}
+
+func NewManager(defaultHasher Hasher, others ...Hasher) *Manager {
+	return &Manager{Default: defaultHasher, hashers: append([]Hasher{defaultHasher}, others...)}
+}
+
+// NewDefaultManager hashes with argon2id and accepts every supported format,
+// including the legacy salted SHA1 hashes.
+func NewDefaultManager() *Manager {
+	return NewManager(NewArgon2id(), NewBcrypt(), NewScrypt(), Legacy{})
+}
+
+func (m *Manager) Hash(password string) (string, error) {
+	return m.Default.Hash(password)
+}
+
+// Verify checks the password against the encoded hash. rehash is true when the
+// password matched but the hash should be replaced by a fresh one from Hash.
+func (m *Manager) Verify(password, encoded string) (ok bool, rehash bool) {
+	for _, h := range m.hashers {
+		if !h.Identify(encoded) {
+			continue
+		}
+		ok, err := h.Verify(password, encoded)
+		if err != nil || !ok {
+			return false, false
+		}
+		return true, h != m.Default || h.NeedsRehash(encoded)
+	}
+	return false, false
+}
+
+func genSalt(size int) ([]byte, error) {
+	salt := make([]byte, size)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return salt, nil
+}
+
+func encodeBase64(b []byte) string {
+	return base64.RawStdEncoding.EncodeToString(b)
+}
+
+func decodeBase64(s string) ([]byte, error) {
+	return base64.RawStdEncoding.DecodeString(s)
+}
+
+// splitEncoded splits "$alg$field$field..." into its fields, the algorithm first.
+func splitEncoded(encoded string, fields int) ([]string, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != fields+1 || parts[0] != "" {
+		return nil, ErrInvalidHash
+	}
+	return parts[1:], nil
+}
@@ -0,0 +1,59 @@
+package hasher
+
+import "testing"
+
+func TestHashersRoundTrip(t *testing.T) {
+	hashers := map[string]Hasher{
+		"argon2id": &Argon2id{Memory: 1024, Time: 1, Threads: 1, SaltLen: 16, KeyLen: 32},
+		"scrypt":   &Scrypt{LogN: 4, R: 8, P: 1, SaltLen: 16, KeyLen: 32},
+		"bcrypt":   &Bcrypt{Cost: 4},
+		"legacy":   Legacy{},
+	}
+
+	for name, h := range hashers {
+		encoded, err := h.Hash("Santo Niño de Cebú")
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !h.Identify(encoded) {
+			t.Errorf("%s does not identify its own hash %s", name, encoded)
+		}
+		if ok, err := h.Verify("Santo Niño de Cebú", encoded); !ok || err != nil {
+			t.Errorf("%s rejected the right password: %v", name, err)
+		}
+		if ok, _ := h.Verify("santo niño de cebú", encoded); ok {
+			t.Errorf("%s accepted the wrong password", name)
+		}
+		other, _ := h.Hash("Santo Niño de Cebú")
+		if other == encoded {
+			t.Errorf("%s produced the same hash twice, salt is not random", name)
+		}
+	}
+}
+
+func TestManagerRehash(t *testing.T) {
+	weak := &Bcrypt{Cost: 4}
+	m := NewManager(&Bcrypt{Cost: 5}, Legacy{})
+
+	legacyHash := "278924da841f2cd2c494a5f39b108836d75d6ef0aea0cec7aa90a9a85a90a7ace23386e0559b577f"
+	if ok, rehash := m.Verify("qweww", legacyHash); !ok || !rehash {
+		t.Errorf("Expected legacy hash to verify and need a rehash, got %t %t", ok, rehash)
+	}
+	if ok, rehash := m.Verify("nope", legacyHash); ok || rehash {
+		t.Errorf("Expected wrong password to fail without rehash, got %t %t", ok, rehash)
+	}
+
+	weakHash, _ := weak.Hash("qweww")
+	if ok, rehash := m.Verify("qweww", weakHash); !ok || !rehash {
+		t.Errorf("Expected lower bcrypt cost to need a rehash, got %t %t", ok, rehash)
+	}
+
+	freshHash, _ := m.Hash("qweww")
+	if ok, rehash := m.Verify("qweww", freshHash); !ok || rehash {
+		t.Errorf("Expected fresh hash not to need a rehash, got %t %t", ok, rehash)
+	}
+
+	if ok, _ := m.Verify("qweww", "$scrypt$ln=4,r=8,p=1$c2FsdA$aGFzaA"); ok {
+		t.Errorf("Expected hash of an unregistered scheme to be rejected")
+	}
+}
@@ -0,0 +1,51 @@
+package hasher
+
+import (
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/hex"
+)
+
+// Legacy verifies the salted SHA1 hashes stored before the hasher package
+// existed: 40 hex chars of nonce followed by 40 hex chars of
+// sha1(pepper + password + nonce). It never produces new hashes worth keeping,
+// so every successful verification asks for a rehash.
+type Legacy struct{}
+
+const legacyPepper = "fZJ9MYnzeaW7q3DY"
+
+func (l Legacy) Identify(encoded string) bool {
+	if len(encoded) != 80 {
+		return false
+	}
+	_, err := hex.DecodeString(encoded)
+	return err == nil
+}
+
+func (l Legacy) Hash(password string) (string, error) {
+	salt, err := genSalt(20)
+	if err != nil {
+		return "", err
+	}
+	nonce := hex.EncodeToString(salt)
+	return nonce + legacySha1(password+nonce), nil
+}
+
+func (l Legacy) Verify(password, encoded string) (bool, error) {
+	if !l.Identify(encoded) {
+		return false, ErrInvalidHash
+	}
+	nonce := encoded[0:40]
+	theHash := encoded[40:]
+	return subtle.ConstantTimeCompare([]byte(legacySha1(password+nonce)), []byte(theHash)) == 1, nil
+}
+
+func (l Legacy) NeedsRehash(encoded string) bool {
+	return true
+}
+
+func legacySha1(password string) string {
+	h := sha1.New()
+	h.Write([]byte(legacyPepper + password))
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,82 @@
+package hasher
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// Scrypt encodes hashes as $scrypt$ln=<log2 N>,r=<r>,p=<p>$<salt>$<hash>.
+type Scrypt struct {
+	LogN    uint8
+	R       int
+	P       int
+	SaltLen int
+	KeyLen  int
+}
+
+func NewScrypt() *Scrypt {
+	return &Scrypt{LogN: 15, R: 8, P: 1, SaltLen: 16, KeyLen: 32}
+}
+
+func (s *Scrypt) Identify(encoded string) bool {
+	return strings.HasPrefix(encoded, "$scrypt$")
+}
+
+func (s *Scrypt) Hash(password string) (string, error) {
+	salt, err := genSalt(s.SaltLen)
+	if err != nil {
+		return "", err
+	}
+	key, err := scrypt.Key([]byte(password), salt, 1<<s.LogN, s.R, s.P, s.KeyLen)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("$scrypt$ln=%d,r=%d,p=%d$%s$%s",
+		s.LogN, s.R, s.P, encodeBase64(salt), encodeBase64(key)), nil
+}
+
+func (s *Scrypt) Verify(password, encoded string) (bool, error) {
+	params, salt, key, err := s.decode(encoded)
+	if err != nil {
+		return false, err
+	}
+	other, err := scrypt.Key([]byte(password), salt, 1<<params.LogN, params.R, params.P, len(key))
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare(key, other) == 1, nil
+}
+
+func (s *Scrypt) NeedsRehash(encoded string) bool {
+	params, salt, key, err := s.decode(encoded)
+	if err != nil {
+		return true
+	}
+	return params.LogN < s.LogN || params.R < s.R || params.P < s.P ||
+		len(salt) < s.SaltLen || len(key) < s.KeyLen
+}
+
+func (s *Scrypt) decode(encoded string) (*Scrypt, []byte, []byte, error) {
+	parts, err := splitEncoded(encoded, 4)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	params := &Scrypt{}
+	if _, err := fmt.Sscanf(parts[1], "ln=%d,r=%d,p=%d", &params.LogN, &params.R, &params.P); err != nil {
+		return nil, nil, nil, ErrInvalidHash
+	}
+
+	salt, err := decodeBase64(parts[2])
+	if err != nil {
+		return nil, nil, nil, ErrInvalidHash
+	}
+	key, err := decodeBase64(parts[3])
+	if err != nil {
+		return nil, nil, nil, ErrInvalidHash
+	}
+	return params, salt, key, nil
+}
@@ -0,0 +1,245 @@
+// Package logger writes leveled, structured log lines as JSON or logfmt:
+//
+//	log.With(logger.Fields{"request_id": id}).Info("request")
+//
+// Fields named like credentials (password, authorization, token, ...) are
+// redacted wherever they appear, including inside documents and headers, so
+// request data can be logged as is.
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Level int
+
+const (
+	DebugLevel Level = iota
+	InfoLevel
+	WarnLevel
+	ErrorLevel
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (level Level) String() string {
+	if level < DebugLevel || level > ErrorLevel {
+		return "level(" + strconv.Itoa(int(level)) + ")"
+	}
+	return levelNames[level]
+}
+
+func ParseLevel(s string) (Level, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(i), nil
+		}
+	}
+	return InfoLevel, fmt.Errorf("unknown log level %q", s)
+}
+
+// Output formats.
+const (
+	FormatJSON   = "json"
+	FormatLogfmt = "logfmt"
+)
+
+// Redacted replaces the values of sensitive fields.
+const Redacted = "[REDACTED]"
+
+// RedactedFields are the field names, lower cased, whose values are never logged.
+var RedactedFields = map[string]bool{
+	"password":      true,
+	"authorization": true,
+	"cookie":        true,
+	"set-cookie":    true,
+	"token":         true,
+	"refresh_token": true,
+	"secret":        true,
+}
+
+type Fields map[string]interface{}
+
+// Logger is safe for concurrent use. The loggers returned by With share the
+// output of their parent. A nil *Logger discards everything.
+type Logger struct {
+	out    *output
+	level  Level
+	format string
+	fields Fields
+}
+
+type output struct {
+	mutex  sync.Mutex
+	writer io.Writer
+}
+
+func New(writer io.Writer, level Level, format string) *Logger {
+	if format != FormatLogfmt {
+		format = FormatJSON
+	}
+	return &Logger{out: &output{writer: writer}, level: level, format: format}
+}
+
+// Discard returns a logger writing nothing, for tests.
+func Discard() *Logger {
+	return nil
+}
+
+// Default logs info and above as JSON to stderr.
+func Default() *Logger {
+	return New(os.Stderr, InfoLevel, FormatJSON)
+}
+
+// With returns a logger adding fields to every line.
+func (l *Logger) With(fields Fields) *Logger {
+	if l == nil {
+		return nil
+	}
+	merged := Fields{}
+	for k, v := range l.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return &Logger{out: l.out, level: l.level, format: l.format, fields: merged}
+}
+
+func (l *Logger) WithField(key string, value interface{}) *Logger {
+	return l.With(Fields{key: value})
+}
+
+func (l *Logger) Enabled(level Level) bool {
+	return l != nil && level >= l.level
+}
+
+func (l *Logger) Debug(msg string) { l.write(DebugLevel, msg) }
+func (l *Logger) Info(msg string)  { l.write(InfoLevel, msg) }
+func (l *Logger) Warn(msg string)  { l.write(WarnLevel, msg) }
+func (l *Logger) Error(msg string) { l.write(ErrorLevel, msg) }
+
+func (l *Logger) Debugf(format string, a ...interface{}) {
+	l.write(DebugLevel, fmt.Sprintf(format, a...))
+}
+func (l *Logger) Infof(format string, a ...interface{}) {
+	l.write(InfoLevel, fmt.Sprintf(format, a...))
+}
+func (l *Logger) Warnf(format string, a ...interface{}) {
+	l.write(WarnLevel, fmt.Sprintf(format, a...))
+}
+func (l *Logger) Errorf(format string, a ...interface{}) {
+	l.write(ErrorLevel, fmt.Sprintf(format, a...))
+}
+
+// Fatal logs at error level and exits.
+func (l *Logger) Fatal(msg string) {
+	l.write(ErrorLevel, msg)
+	os.Exit(1)
+}
+
+func (l *Logger) write(level Level, msg string) {
+	if !l.Enabled(level) {
+		return
+	}
+
+	line := map[string]interface{}{}
+	for k, v := range l.fields {
+		line[k] = redact(k, v)
+	}
+	line["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	line["level"] = level.String()
+	line["msg"] = msg
+
+	var buf bytes.Buffer
+	if l.format == FormatLogfmt {
+		writeLogfmt(&buf, line)
+	} else {
+		writeJSON(&buf, line)
+	}
+
+	l.out.mutex.Lock()
+	defer l.out.mutex.Unlock()
+	l.out.writer.Write(buf.Bytes())
+}
+
+// redact returns value with the sensitive fields of maps, like documents and
+// http.Header, replaced; Redacted when key itself is sensitive.
+func redact(key string, value interface{}) interface{} {
+	if RedactedFields[strings.ToLower(key)] {
+		return Redacted
+	}
+	if err, ok := value.(error); ok {
+		return err.Error()
+	}
+	v := reflect.ValueOf(value)
+	if v.Kind() != reflect.Map || v.Type().Key().Kind() != reflect.String {
+		return value
+	}
+	redacted := map[string]interface{}{}
+	for _, k := range v.MapKeys() {
+		redacted[k.String()] = redact(k.String(), v.MapIndex(k).Interface())
+	}
+	return redacted
+}
+
+func writeJSON(buf *bytes.Buffer, line map[string]interface{}) {
+	encoded, err := json.Marshal(line)
+	if err != nil {
+		encoded, _ = json.Marshal(map[string]interface{}{
+			"time": line["time"], "level": line["level"], "msg": line["msg"], "log_error": err.Error()})
+	}
+	buf.Write(encoded)
+	buf.WriteByte('\n')
+}
+
+// writeLogfmt writes time, level and msg first, then the fields sorted by key.
+func writeLogfmt(buf *bytes.Buffer, line map[string]interface{}) {
+	keys := []string{}
+	for k := range line {
+		if k != "time" && k != "level" && k != "msg" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	keys = append([]string{"time", "level", "msg"}, keys...)
+
+	for i, k := range keys {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(k)
+		buf.WriteByte('=')
+		buf.WriteString(logfmtValue(line[k]))
+	}
+	buf.WriteByte('\n')
+}
+
+func logfmtValue(value interface{}) string {
+	var s string
+	switch v := value.(type) {
+	case string:
+		s = v
+	case fmt.Stringer:
+		s = v.String()
+	case map[string]interface{}, []interface{}:
+		encoded, _ := json.Marshal(v)
+		s = string(encoded)
+	default:
+		s = fmt.Sprint(v)
+	}
+	if s == "" || strings.ContainsAny(s, " =\"\t\n") {
+		return strconv.Quote(s)
+	}
+	return s
+}
@@ -0,0 +1,60 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestJSONRedaction(t *testing.T) {
+	var buf bytes.Buffer
+	log := New(&buf, InfoLevel, FormatJSON).WithField("request_id", "abc")
+
+	header := http.Header{}
+	header.Set("Authorization", "Bearer secret-token")
+	header.Set("Accept", "application/json")
+	log.With(Fields{
+		"body":    map[string]interface{}{"username": "melissa", "password": "raspberry"},
+		"headers": header,
+	}).Info("request")
+	log.Debug("not logged")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("Expected one line, got %q", buf.String())
+	}
+	if strings.Contains(lines[0], "raspberry") || strings.Contains(lines[0], "secret-token") {
+		t.Errorf("Expected credentials to be redacted, got %s", lines[0])
+	}
+
+	line := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(lines[0]), &line); err != nil {
+		t.Fatalf("Invalid json line %q: %v", lines[0], err)
+	}
+	if line["level"] != "info" || line["msg"] != "request" || line["request_id"] != "abc" {
+		t.Errorf("Unexpected line %v", line)
+	}
+	if line["body"].(map[string]interface{})["username"] != "melissa" {
+		t.Errorf("Expected other fields to be kept, got %v", line["body"])
+	}
+}
+
+func TestLogfmt(t *testing.T) {
+	var buf bytes.Buffer
+	log := New(&buf, DebugLevel, FormatLogfmt)
+	log.With(Fields{"status": 404, "path": "/api/users", "password": "x", "note": "two words"}).Debug("done")
+
+	out := buf.String()
+	for _, expected := range []string{"level=debug msg=done ", "note=\"two words\"", "password=[REDACTED]", "path=/api/users", "status=404"} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("Expected %q in %q", expected, out)
+		}
+	}
+}
+
+func TestNilLogger(t *testing.T) {
+	var log *Logger
+	log.With(Fields{"a": 1}).Info("discarded")
+}
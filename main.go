@@ -1,9 +1,19 @@
 package main
 
 import (
+	"log"
+	"os"
+
 	"./api"
+	"./config"
 )
 
 func main() {
-	api.Run()
+	cfg, err := config.Load(os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := api.Run(cfg); err != nil {
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,82 @@
+// Package metrics holds the Prometheus collectors of the API, served on
+// /metrics by Handler.
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Values of the result label.
+const (
+	ResultSuccess = "success"
+	ResultFailure = "failure"
+	// ResultReused counts refresh tokens used twice, a sign of token theft.
+	ResultReused = "reused"
+	// ResultThrottled counts logins refused after too many failures.
+	ResultThrottled = "throttled"
+)
+
+var (
+	// HTTPRequests and HTTPDuration are labelled with the Operation of the
+	// route, like findAllUsers.
+	HTTPRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "api_http_requests_total",
+		Help: "HTTP requests by route operation, method and status.",
+	}, []string{"operation", "method", "status"})
+
+	HTTPDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "api_http_request_duration_seconds",
+		Help:    "HTTP request latencies by route operation, method and status.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"operation", "method", "status"})
+
+	Logins = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "api_auth_logins_total",
+		Help: "Login attempts by result.",
+	}, []string{"result"})
+
+	TokenRefreshes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "api_auth_token_refreshes_total",
+		Help: "Token refreshes by result.",
+	}, []string{"result"})
+
+	DBDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "api_db_operation_duration_seconds",
+		Help:    "Mongo operation latencies by collection and operation.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"collection", "operation"})
+
+	DBErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "api_db_operation_errors_total",
+		Help: "Failed Mongo operations by collection and operation.",
+	}, []string{"collection", "operation"})
+)
+
+func init() {
+	prometheus.MustRegister(HTTPRequests, HTTPDuration, Logins, TokenRefreshes, DBDuration, DBErrors)
+}
+
+// Handler serves the metrics in the Prometheus text format.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+func ObserveRequest(operation, method string, status int, start time.Time) {
+	code := strconv.Itoa(status)
+	HTTPRequests.WithLabelValues(operation, method, code).Inc()
+	HTTPDuration.WithLabelValues(operation, method, code).Observe(time.Since(start).Seconds())
+}
+
+// ObserveDB records an operation started at start; failed tells whether it
+// counts as an error.
+func ObserveDB(collection, operation string, start time.Time, failed bool) {
+	DBDuration.WithLabelValues(collection, operation).Observe(time.Since(start).Seconds())
+	if failed {
+		DBErrors.WithLabelValues(collection, operation).Inc()
+	}
+}
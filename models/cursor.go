@@ -0,0 +1,112 @@
+package models
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"strings"
+
+	"gopkg.in/mgo.v2/bson"
+
+	"../apierror"
+)
+
+// ErrInvalidCursor is returned for page[after] and page[before] tokens that
+// were tampered with, signed with another key or issued for another sort.
+var ErrInvalidCursor = apierror.ErrBadRequest.WithCode("invalid_cursor").WithMessage("Invalid cursor")
+
+// Cursor marks a position in a sorted listing for keyset pagination: it holds
+// the sort keys of the document at the edge of a page. Clients only see it as
+// an opaque token, signed so they cannot forge positions.
+type Cursor struct {
+	Sort   []string      `bson:"s"`
+	Values []interface{} `bson:"v"`
+}
+
+// CursorSort returns sort with _id appended, so that documents with equal
+// sort keys still have a total order.
+func CursorSort(sort []string) []string {
+	for _, key := range sort {
+		if strings.TrimPrefix(key, "-") == "_id" {
+			return sort
+		}
+	}
+	return append(append([]string{}, sort...), "_id")
+}
+
+func NewCursor(sort []string, doc bson.M) *Cursor {
+	values := make([]interface{}, len(sort))
+	for i, key := range sort {
+		values[i] = doc[strings.TrimPrefix(key, "-")]
+	}
+	return &Cursor{Sort: sort, Values: values}
+}
+
+// Encode returns the token of the cursor, signed with key. bson keeps the
+// types of the values, so ids and dates compare correctly once decoded.
+func (c *Cursor) Encode(key []byte) string {
+	payload, _ := bson.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(payload) + "." +
+		base64.RawURLEncoding.EncodeToString(signCursor(key, payload))
+}
+
+func DecodeCursor(token string, key []byte) (*Cursor, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return nil, ErrInvalidCursor
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(signature, signCursor(key, payload)) {
+		return nil, ErrInvalidCursor
+	}
+
+	cursor := &Cursor{}
+	if err := bson.Unmarshal(payload, cursor); err != nil || len(cursor.Sort) != len(cursor.Values) {
+		return nil, ErrInvalidCursor
+	}
+	return cursor, nil
+}
+
+func signCursor(key, payload []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// Filter selects the documents after the cursor in its sort order, or before
+// it when before is true:
+//
+//	{$or: [{a: {$gt: va}}, {a: va, b: {$gt: vb}}, ...]}
+//
+// Missing values sort first, like in Mongo.
+func (c *Cursor) Filter(before bool) bson.M {
+	or := []interface{}{}
+	for i, key := range c.Sort {
+		desc := strings.HasPrefix(key, "-")
+		field := strings.TrimPrefix(key, "-")
+
+		cond := bson.M{}
+		for j := 0; j < i; j++ {
+			cond[strings.TrimPrefix(c.Sort[j], "-")] = c.Values[j]
+		}
+
+		value := c.Values[i]
+		switch greater := desc == before; {
+		case value == nil && !greater:
+			// nothing sorts before a missing value
+			continue
+		case value == nil:
+			cond[field] = bson.M{"$ne": nil}
+		case greater:
+			cond[field] = bson.M{"$gt": value}
+		default:
+			cond["$or"] = []interface{}{bson.M{field: bson.M{"$lt": value}}, bson.M{field: nil}}
+		}
+		or = append(or, cond)
+	}
+	return bson.M{"$or": or}
+}
@@ -2,57 +2,153 @@ package models
 
 import (
 	"fmt"
+	"strings"
 	"time"
 
-	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
+
+	"../apierror"
+	"../metrics"
+	"../ratelimit"
 )
 
+// ModelSettings describes a resource served by the generic CRUD handlers of
+// the api package. Adding a resource only takes a new ModelSettings value.
 type ModelSettings struct {
 	Path, Noun, CollectionName string
 	DataStruct                 interface{}
+
+	// Schema validates request bodies, usually SchemaOf(DataStruct).
+	Schema *Schema
+
+	// OwnerField holds the id of the user owning a document. Principals with
+	// only the "self" scope are restricted to the documents they own.
+	// Leave empty for resources nobody owns.
+	OwnerField string
+
+	// Policy relaxes the default access rules of the resource.
+	Policy AccessPolicy
+
+	// HiddenFields are stored but never returned to clients.
+	HiddenFields []string
+
+	// FilterableFields and SortableFields whitelist the fields clients can use
+	// in filter[field] and sort parameters. DefaultSort applies when no sort
+	// is requested and defaults to _id.
+	FilterableFields []string
+	SortableFields   []string
+	DefaultSort      []string
+
+	// Relationships maps JSON:API relationship names to the fields holding
+	// the ids of related documents.
+	Relationships map[string]Relationship
+
+	// UniqueFields each get a unique index, created at startup and checked by
+	// the readiness probe.
+	UniqueFields []string
+
+	// RateLimits override the default rate limit of the routes of an action,
+	// like ActionWrite. Each action then has its own buckets.
+	RateLimits map[string]ratelimit.Limit
+
+	Hooks *Hooks
 }
 
-type FindAllOutputStruct struct {
-	links struct {
-		self, prev, next string
+type AccessPolicy struct {
+	// OwnerCreate lets principals with only the "self" write scope create
+	// documents; OwnerField is then set to their own id.
+	OwnerCreate bool
+}
+
+// Hide removes write-only and hidden fields from a document before it is returned.
+func (ms *ModelSettings) Hide(doc bson.M) bson.M {
+	if ms.Schema != nil {
+		ms.Schema.Hide(doc)
+	}
+	for _, field := range ms.HiddenFields {
+		delete(doc, field)
+	}
+	return doc
+}
+
+// Relationship links a document to another one through the id stored in Field.
+type Relationship struct {
+	Field string
+	// Type is the collection name of the related documents.
+	Type string
+}
+
+// RelationshipOf returns the name of the relationship stored in field, if any.
+func (ms *ModelSettings) RelationshipOf(field string) string {
+	for name, rel := range ms.Relationships {
+		if rel.Field == field {
+			return name
+		}
 	}
+	return ""
+}
 
-	meta struct {
-		page struct {
-			offset, limit, total int
+// IsHidden tells whether a field is never returned to clients.
+func (ms *ModelSettings) IsHidden(name string) bool {
+	for _, field := range ms.HiddenFields {
+		if field == name {
+			return true
+		}
+	}
+	if ms.Schema != nil {
+		if field, ok := ms.Schema.Field(name); ok && field.Access == AccessWriteOnly {
+			return true
 		}
 	}
+	return false
+}
 
-	data interface{}
+// IsOwnedBy tells whether the document belongs to the user with the given id.
+func (ms *ModelSettings) IsOwnedBy(doc bson.M, userId bson.ObjectId) bool {
+	if ms.OwnerField == "" {
+		return false
+	}
+	return doc[ms.OwnerField] == userId
 }
 
-func FindAll(rootUrl string, collection *mgo.Collection, query bson.M, pageOffset, pageLimit int) (bson.M, error) {
+// FindAll returns one page of the documents matching query, with JSON:API
+// style links and meta. linkParams holds the other query string parameters
+// (filter, sort, fields) to repeat in the links.
+func FindAll(rootUrl string, collection Collection, query *Query, linkParams string) (data bson.M, err error) {
+	defer observe(collection, "find_all", time.Now(), &err)
+
+	if query.Filter == nil {
+		query.Filter = bson.M{}
+	}
+	query.Filter["deleted_at"] = bson.M{"$exists": false}
 
-	pageTotal, err := collection.Find(bson.M{}).Count()
+	pageTotal, err := collection.Count(query.Filter)
 	if err != nil {
 		return nil, err
 	}
 
-	pageLinks := bson.M{"self": fmt.Sprintf("%s?page[offset]=%d&page[limit]=%d", rootUrl, pageOffset, pageLimit)}
+	pageOffset, pageLimit := query.Skip, query.Limit
+	if linkParams != "" {
+		linkParams += "&"
+	}
+
+	pageLinks := bson.M{"self": fmt.Sprintf("%s?%spage[offset]=%d&page[limit]=%d", rootUrl, linkParams, pageOffset, pageLimit)}
 	pageOffsetPrev := pageOffset - pageLimit
 	if pageOffsetPrev >= 0 {
-		pageLinks["prev"] = fmt.Sprintf("%s?page[offset]=%d&page[limit]=%d", rootUrl, pageOffsetPrev, pageLimit)
+		pageLinks["prev"] = fmt.Sprintf("%s?%spage[offset]=%d&page[limit]=%d", rootUrl, linkParams, pageOffsetPrev, pageLimit)
 	}
 
 	pageOffsetNext := pageOffset + pageLimit
 	if pageOffsetNext < pageTotal {
-		pageLinks["next"] = fmt.Sprintf("%s?page[offset]=%d&page[limit]=%d", rootUrl, pageOffsetNext, pageLimit)
+		pageLinks["next"] = fmt.Sprintf("%s?%spage[offset]=%d&page[limit]=%d", rootUrl, linkParams, pageOffsetNext, pageLimit)
 	}
 
-	query["deleted_at"] = bson.M{"$exists": false}
-
-	usr := &[]bson.M{}
-	if err := collection.Find(query).Skip(pageOffset).Limit(pageLimit).Sort("Name").All(usr); err != nil {
+	usr, err := collection.Find(query)
+	if err != nil {
 		return nil, err
 	}
 
-	data := (bson.M{
+	data = (bson.M{
 		"links": pageLinks,
 		"meta":  bson.M{"page": bson.M{"offset": pageOffset, "limit": pageLimit, "total": pageTotal}},
 		"data":  usr})
@@ -60,61 +156,178 @@ func FindAll(rootUrl string, collection *mgo.Collection, query bson.M, pageOffse
 	return data, err
 }
 
-func IsExists(collection *mgo.Collection, query *bson.M) bool {
-	usr := []bson.M{}
-	if err := collection.Find(query).Limit(1).All(&usr); err != nil {
+// FindPage returns the page of documents after the cursor token, or before it
+// when before is true, for keyset pagination. An empty token starts from the
+// first (or last) document. Unlike FindAll it neither skips nor counts
+// documents, so it stays fast on large collections. Cursors are signed with key.
+func FindPage(rootUrl string, collection Collection, query *Query, token string, before bool, key []byte, linkParams string) (data bson.M, err error) {
+	defer observe(collection, "find_page", time.Now(), &err)
+
+	sort := CursorSort(query.Sort)
+	filter := bson.M{"deleted_at": bson.M{"$exists": false}}
+	if query.Filter != nil {
+		filter = bson.M{"$and": []bson.M{query.Filter, filter}}
+	}
+	if token != "" {
+		cursor, err := DecodeCursor(token, key)
+		if err != nil {
+			return nil, err
+		}
+		if strings.Join(cursor.Sort, ",") != strings.Join(sort, ",") {
+			return nil, ErrInvalidCursor
+		}
+		filter = bson.M{"$and": []bson.M{filter, cursor.Filter(before)}}
+	}
+
+	// walk backwards from the cursor, then restore the order
+	findSort := sort
+	if before {
+		findSort = make([]string, len(sort))
+		for i, k := range sort {
+			if strings.HasPrefix(k, "-") {
+				findSort[i] = strings.TrimPrefix(k, "-")
+			} else {
+				findSort[i] = "-" + k
+			}
+		}
+	}
+
+	fields := append([]string{}, query.Fields...)
+	if len(fields) > 0 {
+		// the sort keys are needed to build the cursors
+		for _, k := range sort {
+			fields = append(fields, strings.TrimPrefix(k, "-"))
+		}
+	}
+
+	// one more document tells whether there is a further page
+	docs, err := collection.Find(&Query{Filter: filter, Sort: findSort, Limit: query.Limit + 1, Fields: fields})
+	if err != nil {
+		return nil, err
+	}
+	hasMore := len(docs) > query.Limit
+	if hasMore {
+		docs = docs[:query.Limit]
+	}
+	if before {
+		for i, j := 0, len(docs)-1; i < j; i, j = i+1, j-1 {
+			docs[i], docs[j] = docs[j], docs[i]
+		}
+	}
+
+	if linkParams != "" {
+		linkParams += "&"
+	}
+	pageLink := func(param, token string) string {
+		return fmt.Sprintf("%s?%spage[limit]=%d&page[%s]=%s", rootUrl, linkParams, query.Limit, param, token)
+	}
+
+	pageLinks := bson.M{}
+	if before {
+		pageLinks["self"] = pageLink("before", token)
+	} else {
+		pageLinks["self"] = pageLink("after", token)
+	}
+	if len(docs) > 0 {
+		// there is a previous page when walking back found more documents,
+		// or when walking forward started from a cursor, and conversely
+		if hasMore && before || !before && token != "" {
+			pageLinks["prev"] = pageLink("before", NewCursor(sort, docs[0]).Encode(key))
+		}
+		if hasMore && !before || before && token != "" {
+			pageLinks["next"] = pageLink("after", NewCursor(sort, docs[len(docs)-1]).Encode(key))
+		}
+	}
+
+	data = bson.M{
+		"links": pageLinks,
+		"meta":  bson.M{"page": bson.M{"limit": query.Limit}},
+		"data":  docs}
+
+	return data, nil
+}
+
+func IsExists(collection Collection, query *bson.M) bool {
+	start := time.Now()
+	usr, err := collection.Find(&Query{Filter: *query, Limit: 1})
+	observe(collection, "exists", start, &err)
+	if err != nil {
 		return false
 	}
 	return len(usr) != 0
 }
 
-func FindOne(collection *mgo.Collection, query *bson.M) (bson.M, error) {
-	usr := bson.M{}
-	if err := collection.Find(query).One(&usr); err != nil {
+func FindOne(collection Collection, query *bson.M) (_ bson.M, err error) {
+	defer observe(collection, "find_one", time.Now(), &err)
+	usr, err := collection.FindOne(*query)
+	if err != nil {
 		return nil, err
 	}
 	return usr, nil
 }
 
-func FindId(collection *mgo.Collection, id string) (*bson.M, error) {
-	usr := &bson.M{}
-
+func FindId(collection Collection, id string) (_ *bson.M, err error) {
+	defer observe(collection, "find_id", time.Now(), &err)
+	if !bson.IsObjectIdHex(id) {
+		return nil, ErrInvalidId
+	}
 	// query["deleted_at"] = bson.M{"$exists": false}
-	if err := collection.Find(bson.M{"_id": bson.ObjectIdHex(id), "deleted_at": bson.M{"$exists": false}}).One(usr); err != nil {
+	usr, err := collection.FindOne(bson.M{"_id": bson.ObjectIdHex(id), "deleted_at": bson.M{"$exists": false}})
+	if err != nil {
 		return nil, err
 	}
-	return usr, nil
+	return &usr, nil
 }
 
-func Update(collection *mgo.Collection, id string, usr *bson.M) error {
-
-	fmt.Println("Update data for model", id, usr)
+func Update(collection Collection, id string, usr *bson.M) (err error) {
+	defer observe(collection, "update", time.Now(), &err)
+	if !bson.IsObjectIdHex(id) {
+		return ErrInvalidId
+	}
 
-	if err := collection.UpdateId(bson.ObjectIdHex(id), &bson.M{"$set": usr}); err != nil {
-		fmt.Println("Can't update in model", err)
+	if err := collection.UpdateId(bson.ObjectIdHex(id), *usr); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func Create(collection *mgo.Collection, usr *bson.M) error {
-	if err := collection.Insert(usr); err != nil {
+// Apply atomically updates the first document matching query with Mongo
+// update operators, like $inc, and returns it updated.
+func Apply(collection Collection, query *bson.M, update *bson.M) (_ bson.M, err error) {
+	defer observe(collection, "apply", time.Now(), &err)
+	return collection.Apply(*query, *update)
+}
+
+func Create(collection Collection, usr *bson.M) (err error) {
+	defer observe(collection, "create", time.Now(), &err)
+	if err := collection.Insert(*usr); err != nil {
 		return err
 	}
 	// on future put also the id after insert
 	return nil
 }
 
-func Remove(collection *mgo.Collection, id string) error {
+func Remove(collection Collection, id string) (err error) {
+	defer observe(collection, "remove", time.Now(), &err)
 	/*
 		if err := collection.RemoveId(bson.ObjectIdHex(id)); err != nil {
 			return err
 		}
 	*/
-	if err := collection.UpdateId(bson.ObjectIdHex(id), &bson.M{"$set": bson.M{"deleted_at": time.Now()}}); err != nil {
-		fmt.Println("Can't update in model", err)
+	if !bson.IsObjectIdHex(id) {
+		return ErrInvalidId
+	}
+	if err := collection.UpdateId(bson.ObjectIdHex(id), bson.M{"deleted_at": time.Now()}); err != nil {
 		return err
 	}
 	return nil
 }
+
+// observe records an operation of the helpers in the metrics. Missing
+// documents and invalid input, like bad ids or cursors, are not counted as
+// database errors.
+func observe(collection Collection, operation string, start time.Time, err *error) {
+	_, invalid := (*err).(*apierror.Error)
+	metrics.ObserveDB(collection.Name(), operation, start, *err != nil && *err != ErrNotFound && !invalid)
+}
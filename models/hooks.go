@@ -0,0 +1,74 @@
+package models
+
+import (
+	"net/http"
+
+	"gopkg.in/mgo.v2/bson"
+
+	"../apierror"
+)
+
+// Mailer is the part of the mail queue client hooks can use for side effects.
+type Mailer interface {
+	SendMailViaQueue(from, to, subject, message string) error
+}
+
+// HookContext is what a hook knows about the request it runs for.
+type HookContext struct {
+	Settings   *ModelSettings
+	Collection Collection
+	// AuthInfo is the authenticated principal, nil for anonymous requests like signup.
+	AuthInfo bson.M
+	// Id of the document the request is about, empty on create and on listing.
+	Id      string
+	Request *http.Request
+	Mailer  Mailer
+}
+
+// Hook can change the document in place. Returning an error aborts the
+// request; return a *HookError or an *apierror.Error to choose the HTTP
+// status and message.
+type Hook func(ctx *HookContext, doc bson.M) error
+
+// Hooks hold the resource specific logic run by the generic handlers.
+//
+// Before hooks run on the validated request body (on the stored document for
+// BeforeDelete) and can abort the operation. After hooks run once the change
+// is stored: an error is reported to the client but does not undo it.
+// AfterRead runs on every document returned by find and findAll.
+type Hooks struct {
+	BeforeCreate []Hook
+	AfterCreate  []Hook
+	BeforeUpdate []Hook
+	AfterUpdate  []Hook
+	BeforeDelete []Hook
+	AfterDelete  []Hook
+	AfterRead    []Hook
+}
+
+// HookError aborts a request with the given HTTP status.
+type HookError struct {
+	Status  int
+	Message string
+}
+
+func NewHookError(status int, message string) *HookError {
+	return &HookError{Status: status, Message: message}
+}
+
+func (he *HookError) APIError() *apierror.Error {
+	return apierror.New(he.Status, "", he.Message)
+}
+
+func (he *HookError) Error() string {
+	return he.Message
+}
+
+func RunHooks(hooks []Hook, ctx *HookContext, doc bson.M) error {
+	for _, hook := range hooks {
+		if err := hook(ctx, doc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package models
+
+import (
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+type Pet struct {
+	Id        bson.ObjectId `json:"_id,omitempty" access:"server"`
+	OwnerId   bson.ObjectId `json:"owner_id,omitempty" access:"server"`
+	Name      string        `json:"name" maxLength:"64"`
+	Species   string        `json:"species,omitempty" maxLength:"64"`
+	DeletedAt *time.Time    `json:"deleted_at,omitempty" access:"server"`
+}
+
+func (Pet) SwaggerDoc() map[string]string {
+	return ModelSettingsPet.Schema.SwaggerDoc()
+}
+
+var (
+	ModelSettingsPet = &ModelSettings{
+		Path:             "/pets",
+		Noun:             "Pet",
+		CollectionName:   "pets",
+		DataStruct:       Pet{},
+		Schema:           SchemaOf(Pet{}),
+		OwnerField:       "owner_id",
+		Policy:           AccessPolicy{OwnerCreate: true},
+		FilterableFields: []string{"_id", "owner_id", "name", "species"},
+		SortableFields:   []string{"_id", "name", "species"},
+		DefaultSort:      []string{"name", "_id"},
+		Relationships:    map[string]Relationship{"owner": {Field: "owner_id", Type: "users"}}}
+)
@@ -0,0 +1,93 @@
+package models
+
+import (
+	"strings"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Permissions are written as "<resource>:<action>:<scope>", e.g. "users:read:any".
+// The resource "*" matches every resource.
+const (
+	ActionRead   = "read"
+	ActionWrite  = "write"
+	ActionDelete = "delete"
+
+	ScopeAny  = "any"
+	ScopeSelf = "self"
+)
+
+var (
+	// DefaultRoles are given to users created through signup and to stored
+	// users that have no "roles" field yet, but for the legacy admin user,
+	// given the admin role at startup.
+	DefaultRoles = []string{"user"}
+
+	RolePermissions = map[string][]string{
+		"admin": {"*:read:any", "*:write:any", "*:delete:any"},
+		"user": {
+			"users:read:self", "users:write:self",
+			"pets:read:self", "pets:write:self", "pets:delete:self"},
+	}
+
+	// PrivilegedFields can only be written by a principal holding the "any"
+	// write scope on the resource.
+	PrivilegedFields = []string{"roles", "permissions"}
+)
+
+func UserRoles(usr bson.M) []string {
+	roles := StringList(usr["roles"])
+	if len(roles) == 0 {
+		return DefaultRoles
+	}
+	return roles
+}
+
+// UserPermissions returns the permissions granted by the user's roles plus the
+// ones stored directly on the user record.
+func UserPermissions(usr bson.M) []string {
+	permissions := []string{}
+	for _, role := range UserRoles(usr) {
+		permissions = append(permissions, RolePermissions[role]...)
+	}
+	return append(permissions, StringList(usr["permissions"])...)
+}
+
+// PermissionScope returns the widest scope granted for the action on the
+// resource: ScopeAny, ScopeSelf or "" when not permitted at all.
+func PermissionScope(permissions []string, resource, action string) string {
+	scope := ""
+	for _, permission := range permissions {
+		parts := strings.Split(permission, ":")
+		if len(parts) != 3 {
+			continue
+		}
+		if (parts[0] != resource && parts[0] != "*") || parts[1] != action {
+			continue
+		}
+		switch parts[2] {
+		case ScopeAny:
+			return ScopeAny
+		case ScopeSelf:
+			scope = ScopeSelf
+		}
+	}
+	return scope
+}
+
+// StringList converts a list coming from bson or decoded json into []string.
+func StringList(value interface{}) []string {
+	switch v := value.(type) {
+	case []string:
+		return v
+	case []interface{}:
+		list := []string{}
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				list = append(list, s)
+			}
+		}
+		return list
+	}
+	return nil
+}
@@ -0,0 +1,33 @@
+package models
+
+import (
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestPermissionScope(t *testing.T) {
+	admin := UserPermissions(bson.M{"roles": []interface{}{"admin"}})
+	user := UserPermissions(bson.M{"username": "admin"})
+
+	tests := []struct {
+		permissions      []string
+		resource, action string
+		scope            string
+	}{
+		{admin, "users", ActionRead, ScopeAny},
+		{admin, "pets", ActionDelete, ScopeAny},
+		{user, "users", ActionRead, ScopeSelf},
+		{user, "users", ActionWrite, ScopeSelf},
+		{user, "users", ActionDelete, ""},
+		{user, "pets", ActionDelete, ScopeSelf},
+		{user, "orders", ActionRead, ""},
+		{[]string{"users:read:self", "users:read:any"}, "users", ActionRead, ScopeAny},
+	}
+
+	for _, test := range tests {
+		if scope := PermissionScope(test.permissions, test.resource, test.action); scope != test.scope {
+			t.Errorf("Expected %s:%s with %v to be %q, got %q", test.resource, test.action, test.permissions, test.scope, scope)
+		}
+	}
+}
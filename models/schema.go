@@ -0,0 +1,377 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"gopkg.in/mgo.v2/bson"
+
+	"../apierror"
+)
+
+// Field types accepted by a Schema.
+const (
+	TypeString   = "string"
+	TypeNumber   = "number"
+	TypeInteger  = "integer"
+	TypeBoolean  = "boolean"
+	TypeArray    = "array"
+	TypeObject   = "object"
+	TypeDateTime = "datetime"
+	TypeId       = "id"
+)
+
+// Field access modes, set with the `access` struct tag.
+const (
+	AccessReadWrite = ""
+	// AccessReadOnly fields are returned to clients but rejected in request bodies.
+	AccessReadOnly = "readonly"
+	// AccessWriteOnly fields are accepted from clients but never returned, like passwords.
+	AccessWriteOnly = "writeonly"
+	// AccessServer fields are maintained by the server: returned to clients,
+	// silently dropped from request bodies.
+	AccessServer = "server"
+)
+
+const (
+	ValidateCreate = iota
+	ValidateUpdate
+)
+
+type Field struct {
+	Name      string
+	Type      string
+	Required  bool
+	MaxLength int
+	Pattern   *regexp.Regexp
+	Access    string
+}
+
+// Schema describes the documents of a resource. It is built from the
+// DataStruct of a ModelSettings, so the struct used for the Swagger models is
+// also the one requests are validated against:
+//
+//	Username string `json:"username" maxLength:"64" pattern:"^[a-z]+$"`
+//
+// Fields whose json tag has no omitempty are required on create.
+type Schema struct {
+	Fields []*Field
+	fields map[string]*Field
+}
+
+// FieldError describes why one field of a request body was rejected.
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type ValidationErrors []FieldError
+
+// APIError reports every field error, pointing into the JSON:API form of the
+// request body.
+func (ve ValidationErrors) APIError() *apierror.Error {
+	details := []apierror.Detail{}
+	for _, fe := range ve {
+		details = append(details, apierror.Detail{Code: fe.Code, Message: fe.Message, Pointer: "/data/attributes/" + fe.Field})
+	}
+	return apierror.ErrInvalid.WithDetails(details...)
+}
+
+func (ve ValidationErrors) Error() string {
+	messages := []string{}
+	for _, fe := range ve {
+		messages = append(messages, fe.Message)
+	}
+	return strings.Join(messages, "; ")
+}
+
+var (
+	timeType     = reflect.TypeOf(time.Time{})
+	objectIdType = reflect.TypeOf(bson.ObjectId(""))
+)
+
+// SchemaOf builds the schema of a tagged struct value. It panics on malformed
+// tags since schemas are declared at package initialization.
+func SchemaOf(dataStruct interface{}) *Schema {
+	st := reflect.TypeOf(dataStruct)
+	schema := &Schema{fields: map[string]*Field{}}
+
+	for i := 0; i < st.NumField(); i++ {
+		sf := st.Field(i)
+		jsonTag := strings.Split(sf.Tag.Get("json"), ",")
+		if jsonTag[0] == "-" || sf.PkgPath != "" {
+			continue
+		}
+
+		field := &Field{Name: jsonTag[0], Type: fieldType(sf.Type), Access: sf.Tag.Get("access")}
+		if field.Name == "" {
+			field.Name = sf.Name
+		}
+		field.Required = !(len(jsonTag) > 1 && jsonTag[1] == "omitempty") &&
+			field.Access != AccessReadOnly && field.Access != AccessServer
+
+		if maxLength := sf.Tag.Get("maxLength"); maxLength != "" {
+			n, err := strconv.Atoi(maxLength)
+			if err != nil {
+				panic(fmt.Sprintf("models: invalid maxLength on %s.%s", st.Name(), sf.Name))
+			}
+			field.MaxLength = n
+		}
+		if pattern := sf.Tag.Get("pattern"); pattern != "" {
+			field.Pattern = regexp.MustCompile(pattern)
+		}
+
+		schema.Fields = append(schema.Fields, field)
+		schema.fields[field.Name] = field
+	}
+	return schema
+}
+
+func fieldType(t reflect.Type) string {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch {
+	case t == timeType:
+		return TypeDateTime
+	case t == objectIdType:
+		return TypeId
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return TypeString
+	case reflect.Bool:
+		return TypeBoolean
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return TypeInteger
+	case reflect.Float32, reflect.Float64:
+		return TypeNumber
+	case reflect.Slice, reflect.Array:
+		return TypeArray
+	}
+	return TypeObject
+}
+
+func (schema *Schema) Field(name string) (*Field, bool) {
+	field, ok := schema.fields[name]
+	return field, ok
+}
+
+// Validate checks a request body against the schema. Server-managed fields
+// are removed from data; every other problem is reported as a FieldError.
+// Required fields are only enforced in ValidateCreate mode.
+func (schema *Schema) Validate(data bson.M, mode int) error {
+	errs := ValidationErrors{}
+
+	for name, value := range data {
+		field, ok := schema.fields[name]
+		if !ok {
+			errs = append(errs, FieldError{name, "unknown", name + " is not a known field"})
+			continue
+		}
+		switch field.Access {
+		case AccessServer:
+			delete(data, name)
+			continue
+		case AccessReadOnly:
+			errs = append(errs, FieldError{name, "read_only", name + " is read-only"})
+			continue
+		}
+		value = normalizeValue(field, value)
+		if fe := field.validate(value); fe != nil {
+			errs = append(errs, *fe)
+			continue
+		}
+		data[name] = value
+	}
+
+	if mode == ValidateCreate {
+		for _, field := range schema.Fields {
+			if _, ok := data[field.Name]; field.Required && !ok {
+				errs = append(errs, FieldError{field.Name, "required", field.Name + " is required"})
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (field *Field) validate(value interface{}) *FieldError {
+	if value == nil {
+		if field.Required {
+			return &FieldError{field.Name, "required", field.Name + " is required"}
+		}
+		return nil
+	}
+
+	if !field.hasType(value) {
+		return &FieldError{field.Name, "type", field.Name + " must be of type " + field.Type}
+	}
+
+	if s, ok := value.(string); ok {
+		if field.Required && s == "" {
+			return &FieldError{field.Name, "required", field.Name + " is required"}
+		}
+		if field.MaxLength > 0 && utf8.RuneCountInString(s) > field.MaxLength {
+			return &FieldError{field.Name, "max_length", fmt.Sprintf("%s must be at most %d characters", field.Name, field.MaxLength)}
+		}
+		if field.Pattern != nil && !field.Pattern.MatchString(s) {
+			return &FieldError{field.Name, "format", field.Name + " must match " + field.Pattern.String()}
+		}
+	}
+	return nil
+}
+
+// normalizeValue turns the json.Number and date strings go-restful decodes
+// into the type of the field, so they are not stored as strings.
+func normalizeValue(field *Field, value interface{}) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		switch field.Type {
+		case TypeInteger:
+			if i, err := v.Int64(); err == nil {
+				return i
+			}
+		case TypeNumber:
+			if f, err := v.Float64(); err == nil {
+				return f
+			}
+		}
+	case string:
+		switch field.Type {
+		case TypeDateTime:
+			if t, err := time.Parse(time.RFC3339, v); err == nil {
+				return t
+			}
+		case TypeId:
+			if bson.IsObjectIdHex(v) {
+				return bson.ObjectIdHex(v)
+			}
+		}
+	}
+	return value
+}
+
+// ParseValue converts a query string value, as found in filter[field]=value,
+// to the type of the field.
+func (field *Field) ParseValue(s string) (interface{}, error) {
+	switch field.Type {
+	case TypeString:
+		return s, nil
+	case TypeId:
+		if !bson.IsObjectIdHex(s) {
+			return nil, fmt.Errorf("%s: invalid id %q", field.Name, s)
+		}
+		return bson.ObjectIdHex(s), nil
+	case TypeDateTime:
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid date %q", field.Name, s)
+		}
+		return t, nil
+	case TypeBoolean:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid boolean %q", field.Name, s)
+		}
+		return b, nil
+	case TypeInteger:
+		i, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid integer %q", field.Name, s)
+		}
+		return i, nil
+	case TypeNumber:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid number %q", field.Name, s)
+		}
+		return f, nil
+	case TypeArray:
+		// arrays of strings, matched element-wise by Mongo
+		return s, nil
+	}
+	return nil, fmt.Errorf("%s: cannot filter on %s fields", field.Name, field.Type)
+}
+
+// hasType checks values as decoded from a json request body.
+func (field *Field) hasType(value interface{}) bool {
+	switch field.Type {
+	case TypeString:
+		_, ok := value.(string)
+		return ok
+	case TypeId:
+		_, ok := value.(bson.ObjectId)
+		return ok
+	case TypeDateTime:
+		_, ok := value.(time.Time)
+		return ok
+	case TypeBoolean:
+		_, ok := value.(bool)
+		return ok
+	case TypeNumber:
+		_, ok := value.(float64)
+		return ok
+	case TypeInteger:
+		switch v := value.(type) {
+		case int64:
+			return true
+		case float64:
+			return v == float64(int64(v))
+		}
+		return false
+	case TypeArray:
+		_, ok := value.([]interface{})
+		return ok
+	case TypeObject:
+		_, ok := value.(map[string]interface{})
+		return ok
+	}
+	return false
+}
+
+// Hide removes the write-only fields from a document before it is returned.
+func (schema *Schema) Hide(doc bson.M) bson.M {
+	for _, field := range schema.Fields {
+		if field.Access == AccessWriteOnly {
+			delete(doc, field.Name)
+		}
+	}
+	return doc
+}
+
+// SwaggerDoc describes the constraints of every field; data structs return it
+// from their own SwaggerDoc method so the constraints show up in the API docs.
+func (schema *Schema) SwaggerDoc() map[string]string {
+	doc := map[string]string{}
+	for _, field := range schema.Fields {
+		notes := []string{}
+		switch field.Access {
+		case AccessReadOnly:
+			notes = append(notes, "read-only")
+		case AccessWriteOnly:
+			notes = append(notes, "write-only")
+		case AccessServer:
+			notes = append(notes, "set by the server")
+		}
+		if field.MaxLength > 0 {
+			notes = append(notes, fmt.Sprintf("at most %d characters", field.MaxLength))
+		}
+		if field.Pattern != nil {
+			notes = append(notes, "must match "+field.Pattern.String())
+		}
+		doc[field.Name] = strings.Join(notes, ", ")
+	}
+	return doc
+}
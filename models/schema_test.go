@@ -0,0 +1,75 @@
+package models
+
+import (
+	"encoding/json"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestSchemaValidate(t *testing.T) {
+	schema := ModelSettingsUser.Schema
+
+	data := bson.M{"_id": "5a0000000000000000000000", "username": "melissa", "password": "raspberry"}
+	if err := schema.Validate(data, ValidateCreate); err != nil {
+		t.Fatalf("Expected valid user, got %v", err)
+	}
+	if _, ok := data["_id"]; ok {
+		t.Errorf("Expected server-managed _id to be dropped")
+	}
+
+	tests := []struct {
+		data  bson.M
+		mode  int
+		codes []string
+	}{
+		{bson.M{"username": "melissa"}, ValidateCreate, []string{"required"}},
+		{bson.M{"username": "melissa"}, ValidateUpdate, nil},
+		{bson.M{"username": "mel issa", "password": "x"}, ValidateCreate, []string{"format"}},
+		{bson.M{"username": 42, "password": "x"}, ValidateCreate, []string{"type"}},
+		{bson.M{"pet": string(make([]byte, 65))}, ValidateUpdate, []string{"max_length"}},
+		{bson.M{"deleted": true}, ValidateUpdate, []string{"unknown"}},
+		{bson.M{"password": ""}, ValidateUpdate, []string{"required"}},
+	}
+
+	for _, test := range tests {
+		err := schema.Validate(test.data, test.mode)
+		if test.codes == nil {
+			if err != nil {
+				t.Errorf("Expected %v to be valid, got %v", test.data, err)
+			}
+			continue
+		}
+		errs, ok := err.(ValidationErrors)
+		if !ok || len(errs) != len(test.codes) {
+			t.Errorf("Expected %v to fail with %v, got %v", test.data, test.codes, err)
+			continue
+		}
+		for i, code := range test.codes {
+			if errs[i].Code != code {
+				t.Errorf("Expected %v to fail with %s, got %s", test.data, code, errs[i].Code)
+			}
+		}
+	}
+}
+
+func TestSchemaNormalizesNumbers(t *testing.T) {
+	type Pet struct {
+		Name string  `json:"name"`
+		Age  int     `json:"age,omitempty"`
+		Size float64 `json:"size,omitempty"`
+	}
+	schema := SchemaOf(Pet{})
+
+	data := bson.M{"name": "rex", "age": json.Number("3"), "size": json.Number("1.5")}
+	if err := schema.Validate(data, ValidateCreate); err != nil {
+		t.Fatal(err)
+	}
+	if data["age"] != int64(3) || data["size"] != 1.5 {
+		t.Errorf("Expected numbers to be converted, got %#v", data)
+	}
+
+	if err := schema.Validate(bson.M{"name": "rex", "age": json.Number("3.5")}, ValidateCreate); err == nil {
+		t.Errorf("Expected non integer age to be rejected")
+	}
+}
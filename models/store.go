@@ -0,0 +1,46 @@
+package models
+
+import (
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"../apierror"
+)
+
+var (
+	// ErrNotFound is returned by every backend when a lookup matches no document.
+	ErrNotFound = mgo.ErrNotFound
+
+	// ErrInvalidId is returned by the helpers taking ids as hex strings.
+	ErrInvalidId = apierror.ErrBadRequest.WithCode("invalid_id").WithMessage("Invalid id")
+)
+
+// Query describes a find operation independently of the backend running it.
+type Query struct {
+	Filter bson.M
+	Sort   []string
+	Skip   int
+	Limit  int
+	// Fields restricts the returned fields, all of them when empty.
+	Fields []string
+}
+
+// Collection is the set of operations the models helpers need from a backend.
+type Collection interface {
+	Name() string
+	Count(filter bson.M) (int, error)
+	Find(query *Query) ([]bson.M, error)
+	FindOne(filter bson.M) (bson.M, error)
+	Insert(doc bson.M) error
+	// UpdateId applies the fields of set to the document with the given id ($set semantics).
+	UpdateId(id bson.ObjectId, set bson.M) error
+	// Apply atomically runs update, made of $set, $unset and $inc operators,
+	// on the first document matching filter and returns the updated document.
+	Apply(filter bson.M, update bson.M) (bson.M, error)
+}
+
+// Store hands out collections by name. The API only talks to a Store, so it
+// can run against Mongo or against the in-memory backend.
+type Store interface {
+	C(collectionName string) Collection
+}
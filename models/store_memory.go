@@ -0,0 +1,417 @@
+package models
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// MemoryStore keeps every collection in process memory. It understands the
+// subset of Mongo queries the models helpers build and is meant for tests and
+// local demos.
+type MemoryStore struct {
+	mutex       sync.Mutex
+	collections map[string]*MemoryCollection
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{collections: map[string]*MemoryCollection{}}
+}
+
+func (ms *MemoryStore) C(collectionName string) Collection {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	mc, ok := ms.collections[collectionName]
+	if !ok {
+		mc = &MemoryCollection{name: collectionName}
+		ms.collections[collectionName] = mc
+	}
+	return mc
+}
+
+type MemoryCollection struct {
+	name  string
+	mutex sync.RWMutex
+	docs  []bson.M
+}
+
+func (mc *MemoryCollection) Name() string {
+	return mc.name
+}
+
+func (mc *MemoryCollection) Count(filter bson.M) (int, error) {
+	mc.mutex.RLock()
+	defer mc.mutex.RUnlock()
+
+	count := 0
+	for _, doc := range mc.docs {
+		if matchDocument(doc, filter) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (mc *MemoryCollection) Find(query *Query) ([]bson.M, error) {
+	mc.mutex.RLock()
+	defer mc.mutex.RUnlock()
+
+	docs := []bson.M{}
+	for _, doc := range mc.docs {
+		if matchDocument(doc, query.Filter) {
+			docs = append(docs, copyDocument(doc))
+		}
+	}
+
+	if len(query.Sort) > 0 {
+		sort.SliceStable(docs, func(i, j int) bool {
+			return lessDocument(docs[i], docs[j], query.Sort)
+		})
+	}
+
+	if query.Skip >= len(docs) {
+		return []bson.M{}, nil
+	}
+	docs = docs[query.Skip:]
+	if query.Limit > 0 && query.Limit < len(docs) {
+		docs = docs[:query.Limit]
+	}
+	if len(query.Fields) > 0 {
+		for i, doc := range docs {
+			docs[i] = projectDocument(doc, query.Fields)
+		}
+	}
+	return docs, nil
+}
+
+func (mc *MemoryCollection) FindOne(filter bson.M) (bson.M, error) {
+	mc.mutex.RLock()
+	defer mc.mutex.RUnlock()
+
+	for _, doc := range mc.docs {
+		if matchDocument(doc, filter) {
+			return copyDocument(doc), nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (mc *MemoryCollection) Insert(doc bson.M) error {
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+
+	if _, ok := doc["_id"]; !ok {
+		doc["_id"] = bson.NewObjectId()
+	}
+	for _, existing := range mc.docs {
+		if existing["_id"] == doc["_id"] {
+			// what Mongo returns, so callers can use mgo.IsDup
+			return &mgo.LastError{Code: 11000, Err: fmt.Sprintf("E11000 duplicate key error collection: %s index: _id_ dup key: %v", mc.name, doc["_id"])}
+		}
+	}
+
+	mc.docs = append(mc.docs, copyDocument(doc))
+	return nil
+}
+
+func (mc *MemoryCollection) UpdateId(id bson.ObjectId, set bson.M) error {
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+
+	for _, doc := range mc.docs {
+		if doc["_id"] == id {
+			for key, value := range set {
+				doc[key] = value
+			}
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (mc *MemoryCollection) Apply(filter bson.M, update bson.M) (bson.M, error) {
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+
+	for _, doc := range mc.docs {
+		if !matchDocument(doc, filter) {
+			continue
+		}
+		for op, fields := range update {
+			for key, value := range fields.(bson.M) {
+				switch op {
+				case "$set":
+					doc[key] = value
+				case "$unset":
+					delete(doc, key)
+				case "$inc":
+					current, _ := toFloat(doc[key])
+					increment, _ := toFloat(value)
+					doc[key] = int(current + increment)
+				default:
+					return nil, fmt.Errorf("memory store: unsupported update operator %s", op)
+				}
+			}
+		}
+		return copyDocument(doc), nil
+	}
+	return nil, ErrNotFound
+}
+
+func copyDocument(doc bson.M) bson.M {
+	cp := bson.M{}
+	for key, value := range doc {
+		cp[key] = value
+	}
+	return cp
+}
+
+// projectDocument keeps the given fields and _id, like a Mongo projection.
+func projectDocument(doc bson.M, fields []string) bson.M {
+	projected := bson.M{"_id": doc["_id"]}
+	for _, field := range fields {
+		if value, ok := doc[field]; ok {
+			projected[field] = value
+		}
+	}
+	return projected
+}
+
+func matchDocument(doc bson.M, filter bson.M) bool {
+	for key, cond := range filter {
+		switch key {
+		case "$and":
+			for _, f := range filterList(cond) {
+				if !matchDocument(doc, f) {
+					return false
+				}
+			}
+			continue
+		case "$or":
+			matched := false
+			for _, f := range filterList(cond) {
+				if matchDocument(doc, f) {
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return false
+			}
+			continue
+		}
+
+		value, exists := doc[key]
+		if cond == nil {
+			// null matches missing fields too
+			if exists && value != nil {
+				return false
+			}
+			continue
+		}
+		if ops, ok := cond.(bson.M); ok && isOperatorDocument(ops) {
+			for op, arg := range ops {
+				if !matchOperator(op, value, exists, arg) {
+					return false
+				}
+			}
+			continue
+		}
+		if !exists || !matchEqual(value, cond) {
+			return false
+		}
+	}
+	return true
+}
+
+// filterList returns the filters of an $and or $or condition.
+func filterList(cond interface{}) []bson.M {
+	switch l := cond.(type) {
+	case []bson.M:
+		return l
+	case []interface{}:
+		filters := []bson.M{}
+		for _, f := range l {
+			if filter, ok := f.(bson.M); ok {
+				filters = append(filters, filter)
+			}
+		}
+		return filters
+	}
+	return nil
+}
+
+func isOperatorDocument(ops bson.M) bool {
+	for op := range ops {
+		if !strings.HasPrefix(op, "$") {
+			return false
+		}
+	}
+	return len(ops) > 0
+}
+
+func matchOperator(op string, value interface{}, exists bool, arg interface{}) bool {
+	switch op {
+	case "$exists":
+		return exists == arg.(bool)
+	case "$eq":
+		return exists && matchEqual(value, arg)
+	case "$ne":
+		if arg == nil {
+			return exists && value != nil
+		}
+		return !exists || !matchEqual(value, arg)
+	case "$in", "$nin":
+		found := false
+		if args, ok := arg.([]interface{}); ok {
+			for _, a := range args {
+				if exists && matchEqual(value, a) {
+					found = true
+					break
+				}
+			}
+		}
+		return found == (op == "$in")
+	case "$gt", "$gte", "$lt", "$lte":
+		if !exists {
+			return false
+		}
+		cmp, ok := compareValues(value, arg)
+		if !ok {
+			return false
+		}
+		switch op {
+		case "$gt":
+			return cmp > 0
+		case "$gte":
+			return cmp >= 0
+		case "$lt":
+			return cmp < 0
+		}
+		return cmp <= 0
+	case "$regex":
+		s, ok := value.(string)
+		re, isRegEx := arg.(bson.RegEx)
+		if !ok || !isRegEx {
+			return false
+		}
+		pattern := re.Pattern
+		if strings.Contains(re.Options, "i") {
+			pattern = "(?i)" + pattern
+		}
+		matched, err := regexp.MatchString(pattern, s)
+		return err == nil && matched
+	}
+	return false
+}
+
+// matchEqual compares like Mongo does: a value matches an array holding it.
+func matchEqual(value, cond interface{}) bool {
+	if equalValues(value, cond) {
+		return true
+	}
+	rv := reflect.ValueOf(value)
+	if rv.Kind() != reflect.Slice {
+		return false
+	}
+	for i := 0; i < rv.Len(); i++ {
+		if equalValues(rv.Index(i).Interface(), cond) {
+			return true
+		}
+	}
+	return false
+}
+
+func equalValues(a, b interface{}) bool {
+	if fa, ok := toFloat(a); ok {
+		if fb, ok := toFloat(b); ok {
+			return fa == fb
+		}
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// compareValues orders two values the way the memory backend sorts them.
+// The boolean is false when the values are not comparable.
+func compareValues(a, b interface{}) (int, bool) {
+	if fa, ok := toFloat(a); ok {
+		if fb, ok := toFloat(b); ok {
+			switch {
+			case fa < fb:
+				return -1, true
+			case fa > fb:
+				return 1, true
+			}
+			return 0, true
+		}
+	}
+	switch va := a.(type) {
+	case string:
+		if vb, ok := b.(string); ok {
+			return strings.Compare(va, vb), true
+		}
+	case bson.ObjectId:
+		if vb, ok := b.(bson.ObjectId); ok {
+			return strings.Compare(string(va), string(vb)), true
+		}
+	case time.Time:
+		if vb, ok := b.(time.Time); ok {
+			switch {
+			case va.Before(vb):
+				return -1, true
+			case va.After(vb):
+				return 1, true
+			}
+			return 0, true
+		}
+	}
+	return 0, false
+}
+
+func toFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+func lessDocument(a, b bson.M, sortFields []string) bool {
+	for _, field := range sortFields {
+		desc := strings.HasPrefix(field, "-")
+		field = strings.TrimPrefix(field, "-")
+
+		va, aok := a[field]
+		vb, bok := b[field]
+		if !aok || !bok {
+			// missing fields sort first, like in Mongo
+			if aok == bok {
+				continue
+			}
+			return bok != desc
+		}
+
+		cmp, ok := compareValues(va, vb)
+		if !ok || cmp == 0 {
+			continue
+		}
+		return (cmp < 0) != desc
+	}
+	return false
+}
@@ -0,0 +1,115 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestMemoryStoreHelpers(t *testing.T) {
+	collection := NewMemoryStore().C("users")
+
+	ids := []bson.ObjectId{}
+	for _, username := range []string{"carol", "alice", "bob"} {
+		id := bson.NewObjectId()
+		ids = append(ids, id)
+		if err := Create(collection, &bson.M{"_id": id, "username": username}); err != nil {
+			t.Fatalf("Create %s: %v", username, err)
+		}
+	}
+
+	if err := Create(collection, &bson.M{"_id": ids[0]}); err == nil {
+		t.Errorf("Expected duplicate _id to be rejected")
+	}
+
+	if !IsExists(collection, &bson.M{"username": "alice"}) {
+		t.Errorf("Expected alice to exist")
+	}
+
+	usr, err := FindId(collection, ids[1].Hex())
+	if err != nil || (*usr)["username"] != "alice" {
+		t.Errorf("FindId returned %v, %v", usr, err)
+	}
+
+	if err := Update(collection, ids[1].Hex(), &bson.M{"pet": "cat"}); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	usr, _ = FindId(collection, ids[1].Hex())
+	if (*usr)["pet"] != "cat" || (*usr)["username"] != "alice" {
+		t.Errorf("Update did not merge fields: %v", usr)
+	}
+
+	if err := Remove(collection, ids[2].Hex()); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if _, err := FindId(collection, ids[2].Hex()); err != ErrNotFound {
+		t.Errorf("Expected removed document to be hidden, got %v", err)
+	}
+
+	data, err := FindAll("/users", collection, &Query{Limit: 10}, "")
+	if err != nil {
+		t.Fatalf("FindAll: %v", err)
+	}
+	if docs := data["data"].([]bson.M); len(docs) != 2 {
+		t.Errorf("Expected 2 documents, got %d", len(docs))
+	}
+}
+
+func TestFindPage(t *testing.T) {
+	collection := NewMemoryStore().C("pets")
+	for _, name := range []string{"a", "b", "b", "c", "d"} {
+		Create(collection, &bson.M{"_id": bson.NewObjectId(), "name": name})
+	}
+	Create(collection, &bson.M{"_id": bson.NewObjectId()})
+	key := []byte("key")
+
+	names := func(data bson.M) []interface{} {
+		list := []interface{}{}
+		for _, doc := range data["data"].([]bson.M) {
+			list = append(list, doc["name"])
+		}
+		return list
+	}
+	cursor := func(data bson.M, rel string) string {
+		link, _ := data["links"].(bson.M)[rel].(string)
+		if link == "" {
+			return ""
+		}
+		return link[strings.LastIndex(link, "=")+1:]
+	}
+
+	// walk forward then back again, through a missing name and equal names
+	query := &Query{Sort: []string{"name"}, Limit: 2}
+	seen := []interface{}{}
+	token := ""
+	for page := 0; page < 3; page++ {
+		data, err := FindPage("/pets", collection, query, token, false, key, "")
+		if err != nil {
+			t.Fatalf("FindPage: %v", err)
+		}
+		seen = append(seen, names(data)...)
+		token = cursor(data, "next")
+	}
+	if fmt.Sprint(seen) != "[<nil> a b b c d]" || token != "" {
+		t.Errorf("Expected every pet once in order, got %v, next %q", seen, token)
+	}
+
+	data, _ := FindPage("/pets", collection, query, "", true, key, "")
+	if fmt.Sprint(names(data)) != "[c d]" {
+		t.Errorf("Expected the last page, got %v", names(data))
+	}
+	data, _ = FindPage("/pets", collection, query, cursor(data, "prev"), true, key, "")
+	if fmt.Sprint(names(data)) != "[b b]" {
+		t.Errorf("Expected the previous page, got %v", names(data))
+	}
+
+	token = cursor(data, "next")
+	if _, err := FindPage("/pets", collection, query, token, false, []byte("other"), ""); err != ErrInvalidCursor {
+		t.Errorf("Expected a cursor signed with another key to be rejected, got %v", err)
+	}
+	if _, err := FindPage("/pets", collection, &Query{Sort: []string{"-name"}, Limit: 2}, token, false, key, ""); err != ErrInvalidCursor {
+		t.Errorf("Expected a cursor of another sort to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,172 @@
+package models
+
+import (
+	"io"
+	"net"
+	"regexp"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+type MgoStore struct {
+	database *mgo.Database
+
+	// Operations failing with a connection error are retried this many times,
+	// refreshing the session and doubling Backoff between attempts.
+	Retries int
+	Backoff time.Duration
+}
+
+func NewMgoStore(database *mgo.Database) *MgoStore {
+	return &MgoStore{database: database, Retries: 2, Backoff: 100 * time.Millisecond}
+}
+
+func (ms *MgoStore) C(collectionName string) Collection {
+	return &MgoCollection{ms.database.C(collectionName), ms}
+}
+
+type MgoCollection struct {
+	collection *mgo.Collection
+	store      *MgoStore
+}
+
+func (mc *MgoCollection) Name() string {
+	return mc.collection.Name
+}
+
+func (mc *MgoCollection) Count(filter bson.M) (count int, err error) {
+	err = mc.retry(func() error {
+		count, err = mc.collection.Find(filter).Count()
+		return err
+	})
+	return count, err
+}
+
+func (mc *MgoCollection) Find(query *Query) ([]bson.M, error) {
+	docs := []bson.M{}
+	err := mc.retry(func() error {
+		q := mc.collection.Find(query.Filter).Skip(query.Skip)
+		if query.Limit > 0 {
+			q = q.Limit(query.Limit)
+		}
+		if len(query.Sort) > 0 {
+			q = q.Sort(query.Sort...)
+		}
+		if len(query.Fields) > 0 {
+			selector := bson.M{}
+			for _, field := range query.Fields {
+				selector[field] = 1
+			}
+			q = q.Select(selector)
+		}
+		return q.All(&docs)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return docs, nil
+}
+
+func (mc *MgoCollection) FindOne(filter bson.M) (bson.M, error) {
+	doc := bson.M{}
+	err := mc.retry(func() error {
+		return mc.collection.Find(filter).One(&doc)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// Insert gives the document an _id before the first attempt, so that a retry
+// after an insert that went through finds it rather than adding it twice.
+func (mc *MgoCollection) Insert(doc bson.M) error {
+	if _, ok := doc["_id"]; !ok {
+		doc["_id"] = bson.NewObjectId()
+	}
+	return mc.retry(idempotentInsert(func() error {
+		return mc.collection.Insert(doc)
+	}))
+}
+
+func (mc *MgoCollection) UpdateId(id bson.ObjectId, set bson.M) error {
+	return mc.retry(func() error {
+		return mc.collection.UpdateId(id, bson.M{"$set": set})
+	})
+}
+
+// Apply is not retried: the update may have been applied before the
+// connection failed, and $inc is not idempotent.
+func (mc *MgoCollection) Apply(filter bson.M, update bson.M) (bson.M, error) {
+	doc := bson.M{}
+	if _, err := mc.collection.Find(filter).Apply(mgo.Change{Update: update, ReturnNew: true}, &doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+func (mc *MgoCollection) retry(op func() error) error {
+	return retry(mc.store.Retries, mc.store.Backoff, mc.collection.Database.Session.Refresh, op)
+}
+
+// retry runs op until it doesn't fail with a connection error, at most
+// retries more times, calling refresh after waiting backoff, doubled each time.
+// Only idempotent operations are retried: op may have been applied before its
+// connection failed.
+func retry(retries int, backoff time.Duration, refresh func(), op func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := op()
+		if err == nil || !IsConnectionError(err) || attempt >= retries {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+		refresh()
+	}
+}
+
+// idempotentInsert makes insert, of a document with an _id, safe to retry: a
+// duplicate _id on a retry means an earlier attempt went through.
+func idempotentInsert(insert func() error) func() error {
+	attempts := 0
+	return func() error {
+		attempts++
+		err := insert()
+		if attempts > 1 && isDuplicateId(err) {
+			return nil
+		}
+		return err
+	}
+}
+
+// duplicateId matches the duplicate key errors of the _id index, named _id_,
+// like "index: _id_ dup key" or "users.$_id_  dup key" for older servers.
+var duplicateId = regexp.MustCompile(`[ $]_id_ `)
+
+func isDuplicateId(err error) bool {
+	return mgo.IsDup(err) && duplicateId.MatchString(err.Error())
+}
+
+// connectionErrors are the messages of the unexported errors of mgo telling
+// that the socket was closed or that no server could be reached.
+var connectionErrors = map[string]bool{
+	"Closed explicitly":    true,
+	"no reachable servers": true,
+}
+
+// IsConnectionError tells whether err comes from the connection to Mongo
+// rather than from the query itself, i.e. whether retrying could help.
+func IsConnectionError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if err == io.EOF {
+		return true
+	}
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+	return connectionErrors[err.Error()]
+}
@@ -0,0 +1,90 @@
+package models
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// failingOnce inserts in a memory collection, losing the connection after the
+// first insert went through.
+type failingOnce struct {
+	*MemoryCollection
+	failed bool
+}
+
+func (fo *failingOnce) Insert(doc bson.M) error {
+	err := fo.MemoryCollection.Insert(doc)
+	if !fo.failed {
+		fo.failed = true
+		return io.EOF
+	}
+	return err
+}
+
+func TestRetryInsert(t *testing.T) {
+	store := NewMemoryStore()
+	collection := &failingOnce{MemoryCollection: store.C("users").(*MemoryCollection)}
+	refreshes := 0
+	refresh := func() { refreshes++ }
+
+	doc := bson.M{"_id": bson.NewObjectId(), "username": "alice"}
+	err := retry(2, 0, refresh, idempotentInsert(func() error { return collection.Insert(doc) }))
+	if err != nil || refreshes != 1 {
+		t.Fatalf("Expected the insert to succeed after a retry, got %v after %d refreshes", err, refreshes)
+	}
+	if count, _ := collection.Count(bson.M{}); count != 1 {
+		t.Errorf("Expected the document to be inserted once, got %d", count)
+	}
+
+	// a duplicate _id is an error on the first attempt
+	err = retry(2, 0, refresh, idempotentInsert(func() error { return collection.Insert(doc) }))
+	if !isDuplicateId(err) {
+		t.Errorf("Expected a duplicate _id, got %v", err)
+	}
+
+	other := &mgo.LastError{Code: 11000, Err: "E11000 duplicate key error collection: test.notes index: owner_id_1 dup key"}
+	if isDuplicateId(other) {
+		t.Errorf("Expected a duplicate key of another index not to be a duplicate _id")
+	}
+
+	// connection errors are returned past the retries
+	attempts := 0
+	err = retry(2, 0, refresh, func() error { attempts++; return io.EOF })
+	if err != io.EOF || attempts != 3 {
+		t.Errorf("Expected 3 attempts, got %d: %v", attempts, err)
+	}
+
+	// other errors are not
+	attempts = 0
+	invalid := errors.New("Can't marshal chan int in a BSON document")
+	err = retry(2, 0, refresh, func() error { attempts++; return invalid })
+	if err != invalid || attempts != 1 {
+		t.Errorf("Expected a single attempt, got %d: %v", attempts, err)
+	}
+}
+
+func TestIsConnectionError(t *testing.T) {
+	for _, test := range []struct {
+		err        error
+		connection bool
+	}{
+		{io.EOF, true},
+		{&net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")}, true},
+		{errors.New("no reachable servers"), true},
+		{errors.New("Closed explicitly"), true},
+		{nil, false},
+		{mgo.ErrNotFound, false},
+		{&mgo.LastError{Code: 11000, Err: "E11000 duplicate key"}, false},
+		{&mgo.QueryError{Code: 2, Message: "unknown operator: $foo"}, false},
+		{errors.New("Can't marshal chan int in a BSON document"), false},
+	} {
+		if IsConnectionError(test.err) != test.connection {
+			t.Errorf("%v: expected connection error %v", test.err, test.connection)
+		}
+	}
+}
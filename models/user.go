@@ -1,9 +1,43 @@
 package models
 
+import (
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
 type User struct {
-	username, password, pet string
+	Id          bson.ObjectId `json:"_id,omitempty" access:"server"`
+	Username    string        `json:"username" maxLength:"64" pattern:"^[A-Za-z0-9_.@-]+$"`
+	Password    string        `json:"password" maxLength:"128" access:"writeonly"`
+	Pet         string        `json:"pet,omitempty" maxLength:"64"`
+	Roles       []string      `json:"roles,omitempty"`
+	Permissions []string      `json:"permissions,omitempty"`
+	DeletedAt   *time.Time    `json:"deleted_at,omitempty" access:"server"`
+	// required on signup, verified by following the link mailed to it
+	Email         string `json:"email,omitempty" maxLength:"254" pattern:"^[^@\\s]+@[^@\\s]+$"`
+	EmailVerified bool   `json:"email_verified,omitempty" access:"server"`
+	// failed logins in a row, counted by the login throttle
+	FailedLogins    int        `json:"failed_logins,omitempty" access:"server"`
+	LastFailedLogin *time.Time `json:"last_failed_login,omitempty" access:"server"`
+	LockedUntil     *time.Time `json:"locked_until,omitempty" access:"server"`
+}
+
+func (User) SwaggerDoc() map[string]string {
+	return ModelSettingsUser.Schema.SwaggerDoc()
 }
 
 var (
-	ModelSettingsUser = &ModelSettings{"/users", "User", "users", User{}}
+	ModelSettingsUser = &ModelSettings{
+		Path:           "/users",
+		Noun:           "User",
+		CollectionName: "users",
+		DataStruct:     User{},
+		Schema:         SchemaOf(User{}),
+		// a user owns its own record
+		OwnerField:       "_id",
+		FilterableFields: []string{"_id", "username", "email", "pet", "roles"},
+		SortableFields:   []string{"_id", "username", "pet"},
+		DefaultSort:      []string{"username", "_id"},
+		UniqueFields:     []string{"username", "email"}}
 )
@@ -0,0 +1,167 @@
+// Package ratelimit limits request rates with token buckets: a bucket holds
+// up to Limit.Requests tokens, refilled continuously over Limit.Period, and
+// every request takes one. Buckets live in memory, or in Mongo to be shared
+// between the instances of the API.
+package ratelimit
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Limit lets Requests requests through per Period, in bursts of up to
+// Requests. The zero Limit lets everything through.
+type Limit struct {
+	Requests int
+	Period   time.Duration
+}
+
+func (limit Limit) Unlimited() bool {
+	return limit.Requests <= 0 || limit.Period <= 0
+}
+
+// Result is the state of a bucket after a request took a token from it.
+type Result struct {
+	Allowed   bool
+	Remaining int
+	// Reset is how long until the bucket is full again.
+	Reset time.Duration
+	// RetryAfter is how long until the next token, when the request was refused.
+	RetryAfter time.Duration
+}
+
+type Store interface {
+	// Take takes a token from the bucket of key, if one is left.
+	Take(key string, limit Limit, now time.Time) (Result, error)
+}
+
+// bucket holds the Tokens left at Updated.
+type bucket struct {
+	Tokens  float64   `bson:"tokens"`
+	Updated time.Time `bson:"updated"`
+}
+
+// take refills the bucket for the time elapsed since it was updated, then
+// takes a token. New buckets are full.
+func (b bucket) take(limit Limit, now time.Time) (bucket, Result) {
+	size := float64(limit.Requests)
+	rate := size / limit.Period.Seconds()
+
+	tokens := size
+	if !b.Updated.IsZero() {
+		tokens = math.Min(size, b.Tokens+now.Sub(b.Updated).Seconds()*rate)
+	}
+
+	result := Result{}
+	if tokens >= 1 {
+		tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = seconds((1 - tokens) / rate)
+	}
+	result.Remaining = int(tokens)
+	result.Reset = seconds((size - tokens) / rate)
+	return bucket{Tokens: tokens, Updated: now}, result
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+type MemoryStore struct {
+	mutex   sync.Mutex
+	buckets map[string]memoryBucket
+}
+
+type memoryBucket struct {
+	bucket
+	full time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{buckets: map[string]memoryBucket{}}
+}
+
+func (ms *MemoryStore) Take(key string, limit Limit, now time.Time) (Result, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	b, result := ms.buckets[key].take(limit, now)
+	ms.buckets[key] = memoryBucket{bucket: b, full: now.Add(result.Reset)}
+	if len(ms.buckets)%1024 == 0 {
+		// full buckets are the same as missing ones
+		for k, b := range ms.buckets {
+			if b.full.Before(now) {
+				delete(ms.buckets, k)
+			}
+		}
+	}
+	return result, nil
+}
+
+// MgoStore keeps the buckets in Mongo, removed by a TTL index once full.
+// Concurrent updates of a bucket are detected and retried.
+type MgoStore struct {
+	session *mgo.Session
+	db      string
+}
+
+const (
+	rateLimitsCollection = "rate_limits"
+	maxRetries           = 5
+)
+
+var errContention = errors.New("ratelimit: too many concurrent updates")
+
+func NewMgoStore(session *mgo.Session, db string) (*MgoStore, error) {
+	ms := &MgoStore{session: session, db: db}
+	err := ms.with(func(c *mgo.Collection) error {
+		return c.EnsureIndex(mgo.Index{Key: []string{"expires_at"}, ExpireAfter: time.Second})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ms, nil
+}
+
+func (ms *MgoStore) with(op func(c *mgo.Collection) error) error {
+	session := ms.session.Copy()
+	defer session.Close()
+	return op(session.DB(ms.db).C(rateLimitsCollection))
+}
+
+// Take reads the bucket and writes it back only if nobody updated it in the
+// meantime, retrying otherwise.
+func (ms *MgoStore) Take(key string, limit Limit, now time.Time) (result Result, err error) {
+	err = ms.with(func(c *mgo.Collection) error {
+		for i := 0; i < maxRetries; i++ {
+			current := bucket{}
+			err := c.FindId(key).One(&current)
+			if err != nil && err != mgo.ErrNotFound {
+				return err
+			}
+			found := err == nil
+
+			var next bucket
+			next, result = current.take(limit, now)
+			doc := bson.M{"tokens": next.Tokens, "updated": next.Updated, "expires_at": now.Add(result.Reset)}
+			if found {
+				err = c.Update(bson.M{"_id": key, "updated": current.Updated}, bson.M{"$set": doc})
+			} else {
+				doc["_id"] = key
+				err = c.Insert(doc)
+			}
+			if err == mgo.ErrNotFound || mgo.IsDup(err) {
+				continue
+			}
+			return err
+		}
+		return errContention
+	})
+	return result, err
+}
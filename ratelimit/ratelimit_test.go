@@ -0,0 +1,36 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryStore(t *testing.T) {
+	store := NewMemoryStore()
+	limit := Limit{Requests: 3, Period: 3 * time.Second}
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		result, _ := store.Take("alice", limit, now)
+		if !result.Allowed || result.Remaining != 2-i {
+			t.Fatalf("Request %d: expected %d remaining, got %+v", i, 2-i, result)
+		}
+	}
+	result, _ := store.Take("alice", limit, now)
+	if result.Allowed || result.RetryAfter != time.Second || result.Reset != 3*time.Second {
+		t.Errorf("Expected the empty bucket to refuse the request, got %+v", result)
+	}
+	if result, _ := store.Take("bob", limit, now); !result.Allowed {
+		t.Errorf("Expected another key to have its own bucket, got %+v", result)
+	}
+
+	// a token comes back every second
+	result, _ = store.Take("alice", limit, now.Add(time.Second))
+	if !result.Allowed || result.Remaining != 0 {
+		t.Errorf("Expected a refilled token, got %+v", result)
+	}
+	result, _ = store.Take("alice", limit, now.Add(time.Hour))
+	if !result.Allowed || result.Remaining != 2 {
+		t.Errorf("Expected the bucket to refill up to the limit, got %+v", result)
+	}
+}